@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ArrivalProcess makes a download command open-loop: requests arrive at times drawn from a distribution, independent of
+whether earlier requests have finished, and wait in a queue until one of the workers is free.
+
+	constant: one request every 1/rate seconds
+	poisson:  exponentially distributed inter-arrival times with mean 1/rate
+	trace:    the timestamps (in seconds) of the first column of the trace file
+
+The time a request spends in the queue is recorded apart from its latency, so overload shows up as growing queueing
+delay instead of being hidden by workers that simply issue fewer requests.
+*/
+type ArrivalProcess struct {
+	Kind string
+	Rate float64
+
+	rng *rand.Rand
+}
+
+type arrivedRequest struct {
+	index   int
+	arrival time.Time
+}
+
+// NewArrivalProcess returns nil for the "closed" kind, which keeps the original closed-loop workers.
+func NewArrivalProcess(kind string, rate float64) (*ArrivalProcess, error) {
+	switch kind {
+	case "closed", "":
+		return nil, nil
+	case "constant", "poisson":
+		if rate <= 0 {
+			return nil, fmt.Errorf("arrival %s needs a positive -rate", kind)
+		}
+	case "trace":
+	default:
+		return nil, fmt.Errorf("unknown arrival process %q, expected closed, constant, poisson or trace", kind)
+	}
+	return &ArrivalProcess{
+		Kind: kind,
+		Rate: rate,
+		rng:  seededRand("arrival", 0),
+	}, nil
+}
+
+// Offsets returns the arrival time of n requests relative to the start of the run. traceTimes are only used by the
+// trace kind and must hold at least n timestamps.
+func (a *ArrivalProcess) Offsets(n int, traceTimes []float64) ([]time.Duration, error) {
+	offsets := make([]time.Duration, n)
+	switch a.Kind {
+	case "constant":
+		for i := range offsets {
+			offsets[i] = time.Duration(float64(i) / a.Rate * float64(time.Second))
+		}
+	case "poisson":
+		t := 0.0
+		for i := range offsets {
+			offsets[i] = time.Duration(t * float64(time.Second))
+			t += a.rng.ExpFloat64() / a.Rate
+		}
+	case "trace":
+		if len(traceTimes) < n {
+			return nil, fmt.Errorf("trace has timestamps for %d of %d requests", len(traceTimes), n)
+		}
+		for i := range offsets {
+			offsets[i] = time.Duration((traceTimes[i] - traceTimes[0]) * float64(time.Second))
+			if i > 0 && offsets[i] < offsets[i-1] {
+				return nil, fmt.Errorf("trace timestamps are not sorted at request %d", i)
+			}
+		}
+	}
+	return offsets, nil
+}
+
+// Run releases request i into the queue at offsets[i] and lets workers serve them in arrival order. serve receives
+// the scheduled arrival time, so the queueing delay includes any lag of the dispatcher itself. Once serve returns
+// false no more requests arrive, the ones already queued are still handed to serve.
+func (a *ArrivalProcess) Run(offsets []time.Duration, workers int, serve func(worker, i int, arrival time.Time) bool) {
+	fmt.Printf("open-loop %s arrivals of %d requests, %d workers\n", a.Kind, len(offsets), workers)
+	queue := make(chan arrivedRequest, len(offsets))
+	var stopped int32
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func(worker int) {
+			defer wg.Done()
+			for r := range queue {
+				if !serve(worker, r.index, r.arrival) {
+					atomic.StoreInt32(&stopped, 1)
+				}
+			}
+		}(w)
+	}
+
+	start := time.Now()
+	for i, off := range offsets {
+		if atomic.LoadInt32(&stopped) != 0 {
+			break
+		}
+		arrival := start.Add(off)
+		time.Sleep(time.Until(arrival))
+		queue <- arrivedRequest{index: i, arrival: arrival}
+	}
+	close(queue)
+	wg.Wait()
+}
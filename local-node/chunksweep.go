@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"metrics"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	icore "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	icorepath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// SweepConfig is one point of a chunksweep: how files are split into blocks and laid out into a DAG.
+type SweepConfig struct {
+	Chunker   string
+	Layout    string
+	RawLeaves bool
+}
+
+func (c SweepConfig) String() string {
+	leaves := "pb"
+	if c.RawLeaves {
+		leaves = "raw"
+	}
+	return fmt.Sprintf("%s/%s/%s", c.Chunker, c.Layout, leaves)
+}
+
+func (c SweepConfig) addOptions() []options.UnixfsAddOption {
+	layout := options.BalancedLayout
+	if c.Layout == "trickle" {
+		layout = options.TrickleLayout
+	}
+	return []options.UnixfsAddOption{
+		options.Unixfs.Chunker(c.Chunker),
+		options.Unixfs.Layout(layout),
+		options.Unixfs.RawLeaves(c.RawLeaves),
+		options.Unixfs.Pin(false),
+	}
+}
+
+// SweepConfigs returns every combination of the comma-separated chunkers, layouts and raw-leaves settings.
+// Configurations whose leaf blocks can exceed -blocksizelimit are left out.
+func SweepConfigs(chunkers, layouts, rawLeaves string) ([]SweepConfig, error) {
+	var configs []SweepConfig
+	for _, chunker := range strings.Split(chunkers, ",") {
+		for _, layout := range strings.Split(layouts, ",") {
+			if layout != "balanced" && layout != "trickle" {
+				return nil, fmt.Errorf("unknown layout %q, expected balanced or trickle", layout)
+			}
+			for _, raw := range strings.Split(rawLeaves, ",") {
+				enable, err := strconv.ParseBool(raw)
+				if err != nil {
+					return nil, fmt.Errorf("invalid raw-leaves setting %q, expected true or false", raw)
+				}
+				c := SweepConfig{Chunker: chunker, Layout: layout, RawLeaves: enable}
+				if max := c.maxLeafBlock(); max > metrics.BlockSizeLimit {
+					fmt.Printf("skipping %s, its leaf blocks of up to %d B exceed -blocksizelimit %d\n", c, max, metrics.BlockSizeLimit)
+					continue
+				}
+				configs = append(configs, c)
+			}
+		}
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no configuration to sweep")
+	}
+	return configs, nil
+}
+
+// chunkerMaxBlock returns the largest block a size-<bytes> or rabin-<min>-<avg>-<max> chunker produces, 0 if unknown.
+func chunkerMaxBlock(chunker string) int {
+	parts := strings.Split(chunker, "-")
+	if (parts[0] == "size" && len(parts) == 2) || (parts[0] == "rabin" && len(parts) == 4) {
+		n, _ := strconv.Atoi(parts[len(parts)-1])
+		return n
+	}
+	return 0
+}
+
+// maxLeafBlock returns the largest leaf block of the configuration, 0 if the chunker is unknown. Without raw leaves a
+// chunk is framed as the Data of a unixfs protobuf, which is itself the Data of a dag-pb node.
+func (c SweepConfig) maxLeafBlock() int {
+	n := chunkerMaxBlock(c.Chunker)
+	if n == 0 || c.RawLeaves {
+		return n
+	}
+	// unixfs: Type (tag, value), Data (tag, length, bytes), filesize (tag, value)
+	data := 2 + 1 + uvarintLen(n) + n + 1 + uvarintLen(n)
+	// dag-pb: Data (tag, length, bytes)
+	return 1 + uvarintLen(data) + data
+}
+
+func uvarintLen(n int) int {
+	l := 1
+	for ; n >= 0x80; n >>= 7 {
+		l++
+	}
+	return l
+}
+
+// sweepInput is one file chunksweep adds with every configuration.
+type sweepInput struct {
+	name string
+	size int64
+	open func() (files.Node, error)
+}
+
+/*
+sweepInputs returns the files of a sweep. Without paths these are number files of size bytes from -content. Otherwise
+paths is a comma-separated list of files and directories, every regular file below them is added as it is, so the
+chunkers see the real sizes and contents.
+*/
+func sweepInputs(paths string, size, number int) ([]sweepInput, error) {
+	var inputs []sweepInput
+	if paths == "" {
+		for i := 0; i < number; i++ {
+			i := i
+			inputs = append(inputs, sweepInput{name: fmt.Sprintf("file %d", i), size: int64(size), open: func() (files.Node, error) {
+				data, err := contentGen.Generate(i, size)
+				if err != nil {
+					return nil, err
+				}
+				return files.NewBytesFile(data), nil
+			}})
+		}
+		return inputs, nil
+	}
+	for _, root := range strings.Split(paths, ",") {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			inputs = append(inputs, sweepInput{name: path, size: info.Size(), open: func() (files.Node, error) {
+				return getUnixfsNode(path)
+			}})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the files of %s: %s", root, err)
+		}
+	}
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("no files in %s", paths)
+	}
+	return inputs, nil
+}
+
+// sweepRow collects the results of one configuration.
+type sweepRow struct {
+	config SweepConfig
+	files  int
+	errors int
+	blocks int
+	depth  int
+	add    *metrics.LatencyHistogram
+	get    *metrics.LatencyHistogram
+}
+
+func (r *sweepRow) String() string {
+	blocks := 0.0
+	if r.files > 0 {
+		blocks = float64(r.blocks) / float64(r.files)
+	}
+	return fmt.Sprintf("%-44s %6d %6d %10.2f %10.1f %6d %10.2f %10.2f %10.2f",
+		r.config, r.files, r.errors, r.add.Mean()/metrics.MS, blocks, r.depth,
+		r.get.Mean()/metrics.MS, r.get.Percentile(0.5)/metrics.MS, r.get.Percentile(0.99)/metrics.MS)
+}
+
+/*
+ChunkSweep adds the same inputs with every configuration on one node of a two-node testnet, fetches them from the
+other one, and prints add time, blocks per file, DAG depth and retrieval latency of every configuration in one table.
+Both nodes drop all blocks of a configuration before the next one starts, so no configuration profits from blocks that
+an earlier one shares with it. A block that cannot be dropped aborts the sweep.
+*/
+func ChunkSweep(configs []SweepConfig, inputs []sweepInput, netem *NetemMatrix) error {
+	ctx, tn, cancel, err := StartTestnet(2, netem)
+	if err != nil {
+		return fmt.Errorf("failed to start testnet: %s", err)
+	}
+	defer cancel()
+	defer tn.Close()
+	provider, client := tn.Providers()[0].API, tn.Client().API
+
+	tempDir := "./output"
+	if err := os.MkdirAll(tempDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	var rows []*sweepRow
+	for _, config := range configs {
+		fmt.Printf("-- %s\n", config)
+		row := &sweepRow{config: config, add: metrics.NewLatencyHistogram(), get: metrics.NewLatencyHistogram()}
+		rows = append(rows, row)
+		var added []cid.Cid
+		for _, in := range inputs {
+			file, err := in.open()
+			if err != nil {
+				return err
+			}
+			row.files++
+			start := time.Now()
+			p, err := provider.Unixfs().Add(ctx, file, config.addOptions()...)
+			file.Close()
+			if err != nil {
+				row.errors++
+				results.Op(OpRecord{Op: "upload", Config: config.String(), Size: in.size, Start: start, Error: err.Error()})
+				fmt.Printf("error while adding %s: %s\n", in.name, err.Error())
+				continue
+			}
+			finish := time.Now()
+			results.Op(OpRecord{Op: "upload", Config: config.String(), CID: p.Cid().String(), Size: in.size, Start: start, End: finish})
+			row.add.Update(finish.Sub(start))
+
+			blocks, depth, err := dagShape(ctx, provider, p.Cid())
+			if err != nil {
+				return err
+			}
+			added = append(added, blocks...)
+			row.blocks += len(blocks)
+			if depth > row.depth {
+				row.depth = depth
+			}
+
+			start = time.Now()
+			nd, err := client.Unixfs().Get(ctx, p)
+			if err == nil {
+				_, err = sink.Consume(nd, tempDir+"/"+p.Cid().String())
+			}
+			finish = time.Now()
+			if err != nil {
+				row.errors++
+				results.Op(OpRecord{Op: "get", Config: config.String(), CID: p.Cid().String(), Size: in.size, Start: start, End: finish, Error: err.Error()})
+				fmt.Printf("error while getting %s: %s\n", p.Cid(), err.Error())
+				continue
+			}
+			results.Op(OpRecord{Op: "get", Config: config.String(), CID: p.Cid().String(), Size: in.size, Start: start, End: finish, Peers: connectedPeers(ctx, client)})
+			row.get.Update(finish.Sub(start))
+			if sink.OnDisk() {
+				os.RemoveAll(tempDir + "/" + p.Cid().String())
+			}
+		}
+		// a block left behind would be found locally by the next configuration, so the sweep cannot go on without
+		// dropping it. Blocks that a failed get never fetched are not an error.
+		for _, c := range added {
+			if err := provider.Block().Rm(ctx, icorepath.IpldPath(c), options.Block.Force(true)); err != nil {
+				return fmt.Errorf("failed to drop block %s of %s from the provider: %s", c, config, err)
+			}
+			if err := client.Block().Rm(ctx, icorepath.IpldPath(c), options.Block.Force(true)); err != nil {
+				return fmt.Errorf("failed to drop block %s of %s from the client: %s", c, config, err)
+			}
+		}
+		results.Summary()
+		fmt.Println(row)
+	}
+
+	total := int64(0)
+	for _, in := range inputs {
+		total += in.size
+	}
+	fmt.Printf("\n-- chunksweep of %d files, %d B in total\n", len(inputs), total)
+	fmt.Printf("%-44s %6s %6s %10s %10s %6s %10s %10s %10s\n",
+		"config", "files", "errors", "add(ms)", "blocks", "depth", "get(ms)", "p50(ms)", "p99(ms)")
+	for _, row := range rows {
+		fmt.Println(row)
+	}
+	return tn.CheckNetem(ctx)
+}
+
+// dagShape returns the distinct blocks of the DAG below root and its depth in levels, a single block has depth 1.
+func dagShape(ctx context.Context, ipfs icore.CoreAPI, root cid.Cid) ([]cid.Cid, int, error) {
+	seen := map[cid.Cid]bool{root: true}
+	blocks := []cid.Cid{root}
+	level := []cid.Cid{root}
+	depth := 0
+	for len(level) > 0 {
+		depth++
+		var next []cid.Cid
+		for _, c := range level {
+			nd, err := ipfs.Dag().Get(ctx, c)
+			if err != nil {
+				return nil, 0, err
+			}
+			for _, l := range nd.Links() {
+				if !seen[l.Cid] {
+					seen[l.Cid] = true
+					blocks = append(blocks, l.Cid)
+					next = append(next, l.Cid)
+				}
+			}
+		}
+		level = next
+	}
+	return blocks, depth, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ContentGenerator produces the files of upload, uploadqps and traceUpload, selected with -content:
+
+	text:         random alphanumeric text, the original content
+	random:       incompressible random bytes
+	zero:         zero-filled, every chunk is the same block
+	dup:<pct>:    random blocks of which pct percent repeat one of a small pool of shared blocks, so that block-level
+	              dedup within and across files saves about pct percent
+	prefix:<pct>: random text whose first pct percent are added before the measured uploads, the former -redun
+	dir:<path>:   real data, replayed from the files of a directory
+
+Content only depends on -seed and the index of the file, see workloadSeed.
+*/
+type ContentGenerator interface {
+	// Generate returns the content of file i.
+	Generate(i, size int) ([]byte, error)
+}
+
+// preloader is implemented by generators whose files share content with data that is added unmeasured beforehand.
+type preloader interface {
+	// Preload returns the data to add before file i is uploaded.
+	Preload(i, size int) ([]byte, error)
+}
+
+var contentGen ContentGenerator = textContent{}
+
+// dupPoolSize is the number of distinct shared blocks of the dup generator.
+const dupPoolSize = 16
+
+// NewContentGenerator parses a -content value, blockSize is the chunk size dup generates blocks of.
+func NewContentGenerator(spec string, blockSize int) (ContentGenerator, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "text":
+		return textContent{}, nil
+	case "random":
+		return randomContent{}, nil
+	case "zero":
+		return zeroContent{}, nil
+	case "dup", "prefix":
+		pct, err := strconv.Atoi(arg)
+		if err != nil || pct < 0 || pct > 100 {
+			return nil, fmt.Errorf("content %s needs a percentage from 0 to 100, e.g. %s:30", kind, kind)
+		}
+		if kind == "dup" {
+			return dupContent{pct: pct, blockSize: blockSize}, nil
+		}
+		return prefixContent{pct: pct}, nil
+	case "dir":
+		return newDirContent(arg)
+	}
+	return nil, fmt.Errorf("unknown content %q, expected text, random, zero, dup:<pct>, prefix:<pct> or dir:<path>", spec)
+}
+
+// chunkerBlockSize returns the block size of a size-<bytes> chunker, and the default chunk size for other chunkers.
+func chunkerBlockSize(chunker string) int {
+	if strings.HasPrefix(chunker, "size-") {
+		if n, err := strconv.Atoi(strings.TrimPrefix(chunker, "size-")); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 256 * 1024
+}
+
+type textContent struct{}
+
+func (textContent) Generate(i, size int) ([]byte, error) {
+	return []byte(NewLenChars(size, StdChars, seededRand("content", i))), nil
+}
+
+type randomContent struct{}
+
+func (randomContent) Generate(i, size int) ([]byte, error) {
+	data := make([]byte, size)
+	seededRand("content", i).Read(data)
+	return data, nil
+}
+
+type zeroContent struct{}
+
+func (zeroContent) Generate(i, size int) ([]byte, error) {
+	return make([]byte, size), nil
+}
+
+type dupContent struct {
+	pct       int
+	blockSize int
+}
+
+func (g dupContent) Generate(i, size int) ([]byte, error) {
+	rng := seededRand("content", i)
+	data := make([]byte, size)
+	for off := 0; off < size; off += g.blockSize {
+		block := data[off:]
+		if len(block) > g.blockSize {
+			block = block[:g.blockSize]
+		}
+		if rng.Intn(100) < g.pct {
+			seededRand("dup", rng.Intn(dupPoolSize)).Read(block)
+		} else {
+			rng.Read(block)
+		}
+	}
+	return data, nil
+}
+
+type prefixContent struct {
+	pct int
+}
+
+func (prefixContent) Generate(i, size int) ([]byte, error) {
+	return textContent{}.Generate(i, size)
+}
+
+func (g prefixContent) Preload(i, size int) ([]byte, error) {
+	data, err := g.Generate(i, size)
+	if err != nil {
+		return nil, err
+	}
+	return data[:g.pct*size/100], nil
+}
+
+// dirContent treats the files of a directory, sorted by name, as one endless stream: file i starts at the beginning
+// of file i of the directory (modulo their number) and continues into the following ones until it has its size.
+type dirContent struct {
+	paths []string
+}
+
+func newDirContent(dir string) (*dirContent, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content directory: %s", err)
+	}
+	g := &dirContent{}
+	for _, info := range infos {
+		if info.Mode().IsRegular() && info.Size() > 0 {
+			g.paths = append(g.paths, filepath.Join(dir, info.Name()))
+		}
+	}
+	if len(g.paths) == 0 {
+		return nil, fmt.Errorf("content directory %s has no files", dir)
+	}
+	sort.Strings(g.paths)
+	return g, nil
+}
+
+func (g *dirContent) Generate(i, size int) ([]byte, error) {
+	data := make([]byte, 0, size)
+	for k := i; len(data) < size; k++ {
+		f, err := os.Open(g.paths[k%len(g.paths)])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size-len(data))
+		n, err := io.ReadFull(f, buf)
+		f.Close()
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("failed to read %s: %s", g.paths[k%len(g.paths)], err)
+		}
+		data = append(data, buf[:n]...)
+	}
+	return data, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"metrics"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	icore "github.com/ipfs/interface-go-ipfs-core"
+)
+
+/*
+DirTree describes the directory-shaped content of uploaddir, and how downloads fetch it:
+
+  - every directory above Depth holds Fanout subdirectories d0, d1, ...
+  - every directory at Depth holds Fanout files f0, f1, ... with sizes drawn from Sizes
+
+so a tree holds Fanout^(Depth+1) files. Depth 0 with a large fanout is one flat directory, the shape that HAMT sharding
+(-sharding) is for. Since the layout only depends on Fanout and Depth, a client with the same flags knows every path
+in the tree without listing it. Path selects what downloads fetch of each tree in the cid file:
+
+	"":     the whole tree, as one get
+	all:    every file of the tree, one get each
+	random: one randomly chosen file per tree
+	<path>: that path in every tree, e.g. d0/f3
+*/
+type DirTree struct {
+	Fanout int
+	Depth  int
+	Sizes  *SizeDist
+	Path   string
+}
+
+// dirTree is set for uploaddir and for downloads with -dirpath, nil otherwise.
+var dirTree *DirTree
+
+func NewDirTree(fanout, depth int, sizes *SizeDist, path string) (*DirTree, error) {
+	if fanout < 1 || depth < 0 {
+		return nil, fmt.Errorf("a directory tree needs -fanout >= 1 and -depth >= 0")
+	}
+	if math.Pow(float64(fanout), float64(depth+1)) > 1e7 {
+		return nil, fmt.Errorf("a tree with fanout %d and depth %d has too many files", fanout, depth)
+	}
+	return &DirTree{Fanout: fanout, Depth: depth, Sizes: sizes, Path: path}, nil
+}
+
+// Files returns the paths of all files of the tree relative to its root, in the order they are generated.
+func (t *DirTree) Files() []string {
+	var paths []string
+	var walk func(prefix string, depth int)
+	walk = func(prefix string, depth int) {
+		for i := 0; i < t.Fanout; i++ {
+			if depth == t.Depth {
+				paths = append(paths, fmt.Sprintf("%sf%d", prefix, i))
+			} else {
+				walk(fmt.Sprintf("%sd%d/", prefix, i), depth+1)
+			}
+		}
+	}
+	walk("", 0)
+	return paths
+}
+
+// Generate writes tree number k below dir and returns the total size of its files. File j of the tree is content
+// number k*files+j, so trees differ from each other and only depend on -seed.
+func (t *DirTree) Generate(dir string, k int) (int64, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return 0, err
+	}
+	paths := t.Files()
+	total := int64(0)
+	for j, rel := range paths {
+		index := k*len(paths) + j
+		data, err := contentGen.Generate(index, t.Sizes.Size(index))
+		if err != nil {
+			return total, err
+		}
+		path := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return total, err
+		}
+		if err := ioutil.WriteFile(path, data, 0666); err != nil {
+			return total, err
+		}
+		total += int64(len(data))
+	}
+	return total, nil
+}
+
+// Targets returns what downloads fetches of the tree with the given root, the i-th line of the cid file. A nil tree
+// fetches the root itself.
+func (t *DirTree) Targets(root string, i int) []string {
+	if t == nil || t.Path == "" {
+		return []string{root}
+	}
+	switch t.Path {
+	case "all":
+		paths := t.Files()
+		targets := make([]string, len(paths))
+		for j, rel := range paths {
+			targets[j] = root + "/" + rel
+		}
+		return targets
+	case "random":
+		paths := t.Files()
+		return []string{root + "/" + paths[seededRand("dirpath", i).Intn(len(paths))]}
+	}
+	return []string{root + "/" + strings.Trim(t.Path, "/")}
+}
+
+// SizeDist is the distribution of file sizes in a tree, parsed from -sizedist:
+//
+//	fixed:                      every file has -s bytes
+//	uniform:<min>-<max>:        uniformly between min and max bytes
+//	lognormal:<median>:<sigma>: log-normal around median bytes, the usual shape of real file sizes
+type SizeDist struct {
+	kind    string
+	a, b    float64
+	maxSize int
+}
+
+// maxTreeFileSize caps drawn sizes, the tail of a log-normal distribution is long.
+const maxTreeFileSize = 1 << 30
+
+func ParseSizeDist(spec string, fixed int) (*SizeDist, error) {
+	parts := strings.Split(spec, ":")
+	d := &SizeDist{kind: parts[0], maxSize: maxTreeFileSize}
+	var err error
+	switch {
+	case spec == "fixed":
+		d.a = float64(fixed)
+	case d.kind == "uniform" && len(parts) == 2:
+		bounds := strings.Split(parts[1], "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("size distribution %q, expected uniform:<min>-<max>", spec)
+		}
+		if d.a, err = strconv.ParseFloat(bounds[0], 64); err == nil {
+			d.b, err = strconv.ParseFloat(bounds[1], 64)
+		}
+		if err != nil || d.a < 0 || d.b < d.a {
+			return nil, fmt.Errorf("size distribution %q, expected uniform:<min>-<max>", spec)
+		}
+	case d.kind == "lognormal" && len(parts) == 3:
+		if d.a, err = strconv.ParseFloat(parts[1], 64); err == nil {
+			d.b, err = strconv.ParseFloat(parts[2], 64)
+		}
+		if err != nil || d.a <= 0 || d.b < 0 {
+			return nil, fmt.Errorf("size distribution %q, expected lognormal:<median>:<sigma>", spec)
+		}
+	default:
+		return nil, fmt.Errorf("unknown size distribution %q, expected fixed, uniform:<min>-<max> or lognormal:<median>:<sigma>", spec)
+	}
+	return d, nil
+}
+
+// Size returns the size of content number i.
+func (d *SizeDist) Size(i int) int {
+	var size float64
+	switch d.kind {
+	case "fixed":
+		return int(d.a)
+	case "uniform":
+		size = d.a + seededRand("size", i).Float64()*(d.b-d.a)
+	case "lognormal":
+		size = d.a * math.Exp(d.b*seededRand("size", i).NormFloat64())
+	}
+	if size > float64(d.maxSize) {
+		return d.maxSize
+	}
+	return int(size)
+}
+
+// UploadDir generates number trees and adds each of them as one unixfs directory, the root CIDs go to the cid file.
+func UploadDir(ctx context.Context, ipfs icore.CoreAPI, tree *DirTree, number int, cids string, chunker string) {
+	cidFile, err := os.Create(cids)
+	if err != nil {
+		fmt.Printf("failed to create cid file: %s\n", err.Error())
+		return
+	}
+	defer cidFile.Close()
+
+	fmt.Printf("Uploading %d trees of %d files (fanout %d, depth %d)\n", number, len(tree.Files()), tree.Fanout, tree.Depth)
+	upTimer := metrics.NewLatencyHistogram()
+	totalSize := int64(0)
+	for k := 0; k < number; k++ {
+		if !phases.Next() {
+			break
+		}
+		dir := fmt.Sprintf("./tree%d", k)
+		size, err := tree.Generate(dir, k)
+		if err != nil {
+			fmt.Printf("failed to generate tree %d: %s\n", k, err.Error())
+			return
+		}
+		start := time.Now()
+		root, err := UploadFile(dir, ctx, ipfs, chunker, metrics.CMD_ProvideEach)
+		if err != nil {
+			results.Op(OpRecord{Op: "upload", Size: size, Start: start, Error: err.Error()})
+			fmt.Println(err.Error())
+			return
+		}
+		finish := time.Now()
+		rootCid := root.Cid().String()
+		results.Op(OpRecord{Op: "upload", CID: rootCid, Size: size, Start: start, End: finish})
+		if phases.Measured(start) {
+			upTimer.Update(finish.Sub(start))
+			totalSize += size
+		}
+		manifest.AddFile(rootCid, dir)
+		for _, rel := range tree.Files() {
+			manifest.AddFile(rootCid+"/"+rel, filepath.Join(dir, rel))
+		}
+		fmt.Fprintf(cidFile, "%s\n", rootCid)
+		fmt.Printf("%s tree %d: %d B in %f ms\n", rootCid, k, size, finish.Sub(start).Seconds()*1000)
+	}
+	if upTimer.Count() > 0 {
+		fmt.Printf("%s", metrics.StandardOutput("ipfs-uploaddir", upTimer, int(totalSize/upTimer.Count())))
+	}
+	results.Summary()
+}
@@ -17,6 +17,7 @@ require (
 	github.com/multiformats/go-multiaddr v0.3.3
 	github.com/multiformats/go-multihash v0.0.15
 	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475
+	gopkg.in/yaml.v2 v2.4.0
 	metrics v0.0.0
 )
 
@@ -13,11 +13,12 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"os/user"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -39,6 +40,7 @@ import (
 	"math/rand"
 	gometrcs "github.com/rcrowley/go-metrics"
 	cid "github.com/ipfs/go-cid"
+	uio "github.com/ipfs/go-unixfs/io"
 	"encoding/json"
 )
 
@@ -61,24 +63,21 @@ func setupPlugins(externalPluginsPath string) error {
 	return nil
 }
 
-func createTempRepo(ctx context.Context) (string, error) {
-	/*repoPath, err := ioutil.TempDir("", "ipfs-shell")
+// createTempRepo initializes a repo in a new temp dir, configure (if not nil) may adjust the default config before it is written.
+func createTempRepo(ctx context.Context, configure func(*config.Config)) (string, error) {
+	repoPath, err := ioutil.TempDir("", "ipfs-shell")
 	if err != nil {
 		return "", fmt.Errorf("failed to get temp dir: %s", err)
-	}*/
-
-	u, err := user.Current()
-	if err != nil {
-		fmt.Println("failed to get home dir. ")
 	}
-	repoPath := u.HomeDir + "/.ipfs"
 
-	//repoPath := "~/.ipfs"  // '~'
 	// Create a config with default options and a 2048 bit key
 	cfg, err := config.Init(ioutil.Discard, 2048)
 	if err != nil {
 		return "", err
 	}
+	if configure != nil {
+		configure(cfg)
+	}
 
 	// Create the repo with the config
 	//err = fsrepo.Init(repoPath, cfg)
@@ -126,7 +125,7 @@ func spawnEphemeral(ctx context.Context) (icore.CoreAPI, error) {
 	}
 
 	// Create a Temporary Repo
-	repoPath, err := createTempRepo(ctx)
+	repoPath, err := createTempRepo(ctx, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create temp repo: %s", err)
 	}
@@ -192,27 +191,23 @@ func getUnixfsNode(path string) (files.Node, error) {
 
 // NOTE: I modified function here adding a chunker para.
 func UploadFile(file string, ctx context.Context, ipfs icore.CoreAPI, chunker string, ProvideThrough bool) (icorepath.Resolved, error) {
+	return uploadFile(file, ctx, ipfs, chunker, ProvideThrough, true)
+}
+
+// uploadFile adds file like UploadFile, measure false keeps the upload out of the timers whatever the phase, e.g. the
+// preload of -content prefix.
+func uploadFile(file string, ctx context.Context, ipfs icore.CoreAPI, chunker string, ProvideThrough bool, measure bool) (icorepath.Resolved, error) {
+	// concurrent uploads keep their breakdowns apart
+	ctx, col := metrics.WithCollector(ctx)
+	start := time.Now()
 	defer func() {
-		if !metrics.CMD_EnableMetrics {
-			return
+		// the timers only measure the steady state
+		if measure && phases.Measured(start) {
+			col.Collect()
+		} else {
+			col.Discard()
 		}
-		metrics.AddTimer.Update(metrics.AddDura)
-		metrics.Provide.Update(metrics.ProvideDura)
-		metrics.Persist.Update(metrics.PersistDura)
-
-		dagTime := metrics.AddDura - metrics.ProvideDura - metrics.PersistDura
-		metrics.Dag.Update(dagTime)
-
-		metrics.FlatfsHasTimer.Update(metrics.FlatfsHasDura)
-		metrics.FlatfsPut.Update(metrics.FlatfsPutDura)
-
-		metrics.FlatfsPutDura = 0
-		metrics.FlatfsHasDura = 0
-		metrics.AddDura = 0
-		metrics.ProvideDura = 0
-		metrics.PersistDura = 0
 	}()
-	start := time.Now()
 	somefile, err := getUnixfsNode(file)
 	if err != nil {
 		return nil, err
@@ -232,13 +227,13 @@ func UploadFile(file string, ctx context.Context, ipfs icore.CoreAPI, chunker st
 		return nil, err
 	}
 
-	metrics.AddDura += time.Now().Sub(start)
+	metrics.Record(ctx, metrics.StageAdd, time.Now().Sub(start))
 	//quieoo.AddTimer.UpdateSince(start)
 	return cid, err
 }
 
 // NOTE: I modified the function for adding a para named chunker.
-func Upload(size, number, cores int, ctx context.Context, ipfs icore.CoreAPI, cids string, redun int, chunker string, reGenerate bool) {
+func Upload(size, number, cores int, ctx context.Context, ipfs icore.CoreAPI, cids string, chunker string, reGenerate bool) {
 	cidFile, _ := os.Create(cids)
 	fmt.Printf("Uploading files with size %d B\n", size)
 	coreNumber := cores
@@ -264,21 +259,33 @@ func Upload(size, number, cores int, ctx context.Context, ipfs icore.CoreAPI, ci
 
 			//create new temp files
 			for j := 0; j < number/coreNumber; j++ {
-				var subs string
-				subs = NewLenChars(size, StdChars)
-
-				// if redundancy rate is set, first upload files: [:redun/100*size]
-				if redun > 0 && redun <= 100 {
-					rsubs := subs[:redun*size/100]
-					tempfile := tempDir + "/temp"
-					err := ioutil.WriteFile(tempfile, []byte(rsubs), 0666)
+				fileIndex := i*(number/coreNumber) + j
+				subs, err := contentGen.Generate(fileIndex, size)
+				if err != nil {
+					fmt.Println(err.Error())
+					stallchan <- i
+					return
+				}
+
+				// if the content shares data with a preload (-content prefix:<pct>, -redun), first upload that
+				if pre, ok := contentGen.(preloader); ok {
+					rsubs, err := pre.Preload(fileIndex, size)
+					if err != nil {
+						fmt.Println(err.Error())
+						stallchan <- i
+						return
+					}
+					tempfile := tempDir + ".preload"
+					err = ioutil.WriteFile(tempfile, rsubs, 0666)
 					if err != nil {
 						fmt.Println(err.Error())
 						stallchan <- i
 						return
 					}
 					start := time.Now()
-					cid, err := UploadFile(tempfile, ctx, ipfs, chunker, metrics.CMD_ProvideEach)
+					// the preload is not measured, the timers keep only the real uploads
+					cid, err := uploadFile(tempfile, ctx, ipfs, chunker, metrics.CMD_ProvideEach, false)
+					os.Remove(tempfile)
 					if err != nil {
 						fmt.Println(err.Error())
 						stallchan <- i
@@ -287,8 +294,8 @@ func Upload(size, number, cores int, ctx context.Context, ipfs icore.CoreAPI, ci
 					fmt.Printf("%s sub-file %f ms\n", cid.Cid(), time.Now().Sub(start).Seconds()*1000)
 				}
 
-				inputpath := tempDir + "/" + subs[:10]
-				err = ioutil.WriteFile(inputpath, []byte(subs), 0666)
+				inputpath := fmt.Sprintf("%s/%08d", tempDir, fileIndex)
+				err = ioutil.WriteFile(inputpath, subs, 0666)
 				if err != nil {
 					fmt.Println(err.Error())
 					stallchan <- i
@@ -296,10 +303,6 @@ func Upload(size, number, cores int, ctx context.Context, ipfs icore.CoreAPI, ci
 				}
 			}
 		}
-		// if redundancy rate is set, we clear the metrics before real uploads
-		if redun > 0 && redun <= 100 {
-			metrics.TimersInit()
-		}
 		//upload temp files
 		tempfiles, err := ioutil.ReadDir(tempDir)
 		firstupload := true
@@ -309,6 +312,9 @@ func Upload(size, number, cores int, ctx context.Context, ipfs icore.CoreAPI, ci
 			return
 		}
 		for _, f := range tempfiles {
+			if !phases.Next() {
+				break
+			}
 			tempFile := tempDir + "/" + f.Name()
 			start := time.Now()
 			//add file to ipfs local node
@@ -325,11 +331,14 @@ func Upload(size, number, cores int, ctx context.Context, ipfs icore.CoreAPI, ci
 			}
 			cid, err := UploadFile(tempFile, ctx, ipfs, chunker, provide)
 			if err != nil {
+				results.Op(OpRecord{Op: "upload", Worker: i, Size: f.Size(), Start: start, Error: err.Error()})
 				fmt.Println(err.Error())
 				stallchan <- i
 				return
 			}
 			finish := time.Now()
+			results.Op(OpRecord{Op: "upload", Worker: i, CID: cid.Cid().String(), Size: f.Size(), Start: start, End: finish})
+			manifest.AddFile(cid.Cid().String(), tempFile)
 			fmt.Printf("%s upload %f ms\n", cid.Cid(), finish.Sub(start).Seconds()*1000)
 			if err != nil {
 				fmt.Println(err.Error())
@@ -360,6 +369,7 @@ func Upload(size, number, cores int, ctx context.Context, ipfs icore.CoreAPI, ci
 			stalls--
 			if stalls <= 0 {
 				cidFile.Close()
+				results.Summary()
 				if metrics.CMD_StallAfterUpload {
 					fmt.Println("Finish Front-End")
 					sigChan := make(chan os.Signal)
@@ -374,7 +384,7 @@ func Upload(size, number, cores int, ctx context.Context, ipfs icore.CoreAPI, ci
 	}
 }
 
-func DownloadSerial(ctx context.Context, ipfs icore.CoreAPI, cids string, pag bool, np string, concurrentGet int, sad bool) {
+func DownloadSerial(ctx context.Context, ipfs icore.CoreAPI, cids string, pag bool, np string, concurrentGet int, sad bool, arrival *ArrivalProcess) {
 	//peers to remove after each get
 	// neighbours, err := LocalNeighbour(np)
 	// if err != nil || len(neighbours) == 0 {
@@ -408,6 +418,7 @@ func DownloadSerial(ctx context.Context, ipfs icore.CoreAPI, cids string, pag bo
 		fileCid[i] = make([]string, 0)
 	}
 
+	var allCids []string
 	tmpCnt := 0
 	for {
 		aLine, readErr := inputReader.ReadString('\n')
@@ -415,233 +426,359 @@ func DownloadSerial(ctx context.Context, ipfs icore.CoreAPI, cids string, pag bo
 		if readErr == io.EOF {
 			break
 		}
-		fileCid[tmpCnt%concurrentGet] = append(fileCid[tmpCnt%concurrentGet], aLine)
-		tmpCnt++
+		for _, target := range dirTree.Targets(aLine, len(allCids)) {
+			fileCid[tmpCnt%concurrentGet] = append(fileCid[tmpCnt%concurrentGet], target)
+			allCids = append(allCids, target)
+			tmpCnt++
+		}
+	}
+	if arrival != nil {
+		offsets, err := arrival.Offsets(len(allCids), nil)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		downTimer := metrics.NewLatencyHistogram()
+		var sizeLock sync.Mutex
+		fileSize := int64(0)
+		arrival.Run(offsets, concurrentGet, func(worker, i int, arrived time.Time) bool {
+			if !phases.Next() {
+				return false
+			}
+			size, _ := downloadFile(ctx, ipfs, worker, allCids[i], tempDir, pag, arrived, downTimer)
+			sizeLock.Lock()
+			if fileSize == 0 {
+				fileSize = size
+			}
+			sizeLock.Unlock()
+			return true
+		})
+		fmt.Printf("open-loop %s", metrics.StandardOutput("ipfs-download", downTimer, int(fileSize)))
+		if verifier != nil {
+			fmt.Printf("verification failures: %d\n", verifier.Failures())
+		}
+		results.Summary()
+		if sad {
+			select {}
+		}
+		return
 	}
+
 	var wg sync.WaitGroup
+	var allLock sync.Mutex
+	allTimer := metrics.NewLatencyHistogram()
+	allSize := int64(0)
 	wg.Add(concurrentGet)
-	if sad {
-		wg.Add(1)
-	}
 	for i := 0; i < concurrentGet; i++ {
 		go func(theOrder int) {
 			defer wg.Done()
-			downTimer := gometrcs.NewTimer()
+			downTimer := metrics.NewLatencyHistogram()
 			fileSize := int64(0)
 			// output file cids
 			fmt.Printf("worker-%d downloading %d files\n", theOrder, len(fileCid[theOrder]))
 			for j := 0; j < len(fileCid[theOrder]); j++ {
-				ctx_time, _ := context.WithTimeout(ctx, 60*time.Minute)
-				cid := fileCid[theOrder][j]
-				p := icorepath.New(cid)
-				start := time.Now()
-				if metrics.CMD_EnableMetrics {
-					metrics.BDMonitor.GetStartTime = start
-				}
-				rootNode, err := ipfs.Unixfs().Get(ctx_time, p)
-				if err != nil {
-					fmt.Printf("error while get %s: %s\n", cid, err.Error())
-					continue
+				if !phases.Next() {
+					break
 				}
+				size, stop := downloadFile(ctx, ipfs, theOrder, fileCid[theOrder][j], tempDir, pag, time.Time{}, downTimer)
 				if fileSize == 0 {
-					fileSize, _ = rootNode.Size()
-				}
-				// fmt.Println("file size: ", fileSize)
-				if metrics.CMD_EnableMetrics {
-					metrics.GetNode.UpdateSince(start)
+					fileSize = size
 				}
-				startWrite := time.Now()
-				err = files.WriteTo(rootNode, tempDir+"/"+cid)
-				if err != nil {
-					fmt.Printf("error while write to file %s : %s\n", cid, err.Error())
-					continue
-				}
-				if metrics.CMD_EnableMetrics {
-					metrics.WriteTo.UpdateSince(startWrite)
-					metrics.BDMonitor.GetFinishTime = time.Now()
-					//metrics.Output_Get_SingleFile()
-					//metrics.BDMonitor = metrics.Newmonitor()
-					metrics.CollectMonitor()
-					metrics.FPMonitor.CollectFPMonitor()
+				if stop {
+					return
 				}
-				downTimer.UpdateSince(start)
+			}
+			fmt.Printf("worker-%d %s", theOrder, metrics.StandardOutput("ipfs-download", downTimer, int(fileSize)))
+			allTimer.Merge(downTimer)
+			allLock.Lock()
+			if allSize == 0 {
+				allSize = fileSize
+			}
+			allLock.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	if concurrentGet > 1 {
+		fmt.Printf("all-workers %s", metrics.StandardOutput("ipfs-download", allTimer, int(allSize)))
+	}
+	if verifier != nil {
+		fmt.Printf("verification failures: %d\n", verifier.Failures())
+	}
+	results.Summary()
+	if sad {
+		// stall after download, keep serving the fetched blocks
+		select {}
+	}
+}
 
-				if metrics.CMD_PeerRH {
-					metrics.Output_PeerRH()
-				}
-				fmt.Printf("Thread %d get file %s %f\n", theOrder, cid, time.Now().Sub(start).Seconds()*1000)
+// schedulers are the pbitswap schedulers of -scheduler, downloads take them in turn
+var schedulers []string
+var nextScheduler uint32
 
-				//provide after get
-				if pag {
-					err := ipfs.Dht().Provide(ctx, p)
-					if err != nil {
-						fmt.Printf("failed to provide file after get: %v\n", err.Error())
-						return
-					}
-				}
+// withScheduler picks the scheduler of the next download. config names it if there is more than one to compare, and is
+// empty otherwise so results of a single scheduler stay as they were.
+func withScheduler(ctx context.Context) (_ context.Context, config string) {
+	if !metrics.EnablePbitswap || len(schedulers) < 2 {
+		return ctx, ""
+	}
+	name := schedulers[int(atomic.AddUint32(&nextScheduler, 1)-1)%len(schedulers)]
+	return metrics.WithScheduler(ctx, name), "scheduler=" + name
+}
 
-				// DO NOT WORK
-				//DisconnectAllPeers(ctx, ipfs)
-				//remove neighbours
+// downloadFile gets one file into tempDir and records it, arrival is the time the request entered the queue of an
+// open-loop run and zero otherwise. stop is set if the worker should not fetch any more files.
+func downloadFile(ctx context.Context, ipfs icore.CoreAPI, worker int, cid string, tempDir string, pag bool, arrival time.Time, downTimer *metrics.LatencyHistogram) (size int64, stop bool) {
+	ctx_sched, config := withScheduler(ctx)
+	// concurrent gets keep their breakdowns apart
+	ctx_col, col := metrics.WithCollector(ctx_sched)
+	defer col.Discard()
+	ctx_time, _ := context.WithTimeout(ctx_col, 60*time.Minute)
+	p := icorepath.New(cid)
+	start := time.Now()
+	if metrics.CMD_EnableMetrics {
+		col.Monitor.GetStartTime = start
+	}
+	rootNode, err := ipfs.Unixfs().Get(ctx_time, p)
+	if err != nil {
+		results.Op(OpRecord{Op: "get", Config: config, Worker: worker, CID: cid, Arrival: arrival, Start: start, Error: err.Error(), Peers: connectedPeers(ctx, ipfs)})
+		fmt.Printf("error while get %s: %s\n", cid, err.Error())
+		return 0, false
+	}
+	size, _ = rootNode.Size()
+	// the timers only measure the steady state
+	measured := phases.Measured(start)
+	if metrics.CMD_EnableMetrics && measured {
+		metrics.GetNode.UpdateSince(start)
+	}
+	startWrite := time.Now()
+	// paths within a directory tree are written flat
+	local := tempDir + "/" + strings.Replace(cid, "/", "_", -1)
+	consumed, err := sink.Consume(rootNode, local)
+	if err != nil {
+		results.Op(OpRecord{Op: "get", Config: config, Worker: worker, CID: cid, Arrival: arrival, Size: size, Start: start, Error: err.Error(), Peers: connectedPeers(ctx, ipfs)})
+		fmt.Printf("error while write to file %s : %s\n", cid, err.Error())
+		return size, false
+	}
+	finish := time.Now()
+	verified, err := verifier.Verify(ctx, ipfs, cid, local, consumed.Sha256)
+	if err != nil {
+		results.Op(OpRecord{Op: "get", Config: config, Worker: worker, CID: cid, Arrival: arrival, Size: size, Start: start, End: finish, Error: err.Error(), Verify: verified, Peers: connectedPeers(ctx, ipfs)})
+		fmt.Println(err.Error())
+		return size, false
+	}
+	results.Op(withTimeline(OpRecord{Op: "get", Config: config, Worker: worker, CID: cid, Arrival: arrival, Size: size, Start: start, End: finish, Verify: verified, Providers: col.Monitor.Senders(), Peers: connectedPeers(ctx, ipfs)}, col, consumed.FirstByte))
+	if metrics.CMD_EnableMetrics {
+		col.Monitor.GetFinishTime = time.Now()
+		//metrics.Output_Get_SingleFile()
+		if measured {
+			metrics.WriteTo.UpdateSince(startWrite)
+			col.Collect()
+		} else {
+			col.Discard()
+		}
+	}
+	if measured {
+		downTimer.Update(finish.Sub(start))
+	}
 
-				if len(disconnectNeighbours) != 0 {
-					for _, n := range disconnectNeighbours {
-						//fmt.Printf("try to disconnect from %s\n", n)
-						err := DisconnectAllPeers(ctx, ipfs, n)
-						if err != nil {
-							fmt.Printf("failed to disconnect: %v\n", err)
-						}
-					}
-				}
+	if metrics.CMD_PeerRH {
+		metrics.Output_PeerRH()
+	}
+	if arrival.IsZero() {
+		fmt.Printf("Thread %d get file %s %f\n", worker, cid, time.Now().Sub(start).Seconds()*1000)
+	} else {
+		fmt.Printf("Thread %d get file %s %f queue %f\n", worker, cid, time.Now().Sub(start).Seconds()*1000, start.Sub(arrival).Seconds()*1000)
+	}
+
+	//provide after get
+	if pag {
+		err := ipfs.Dht().Provide(ctx, p)
+		if err != nil {
+			fmt.Printf("failed to provide file after get: %v\n", err.Error())
+			return size, true
+		}
+	}
+
+	// DO NOT WORK
+	//DisconnectAllPeers(ctx, ipfs)
+	//remove neighbours
+
+	if len(disconnectNeighbours) != 0 {
+		for _, n := range disconnectNeighbours {
+			//fmt.Printf("try to disconnect from %s\n", n)
+			err := DisconnectAllPeers(ctx, ipfs, n)
+			if err != nil {
+				fmt.Printf("failed to disconnect: %v\n", err)
 			}
-			fmt.Printf("worker-%d %s", theOrder, metrics.StandardOutput("ipfs-download", downTimer, int(fileSize)))
-		}(i)
+		}
 	}
-	wg.Wait()
+	return size, false
 }
+
 func FindProviderQPS(qps int, ctx context.Context, ipfs icore.CoreAPI, cidFile string, numProviders int) {
 
-    // 打开 CID 文件
-    file, err := os.Open(cidFile)
-    if err != nil {
-        fmt.Printf("无法打开 CID 文件: %v\n", err)
-        return
-    }
-    defer file.Close()
+	// 打开 CID 文件
+	file, err := os.Open(cidFile)
+	if err != nil {
+		fmt.Printf("failed to open CID file: %v\n", err)
+		return
+	}
+	defer file.Close()
 
-    // 从 CID 文件中读取所有的 CID
-    inputReader := bufio.NewReader(file)
-    var cidList []string
-    for {
-        cidLine, readErr := inputReader.ReadString('\n')
-        cidLine = strings.TrimSpace(cidLine) // 去掉换行符和多余空格
-        if readErr == io.EOF {
-            break
-        }
-        if cidLine != "" {
-            cidList = append(cidList, cidLine) // 添加到 CID 列表
-        }
-    }
+	// 从 CID 文件中读取所有的 CID
+	inputReader := bufio.NewReader(file)
+	var cidList []string
+	for {
+		cidLine, readErr := inputReader.ReadString('\n')
+		cidLine = strings.TrimSpace(cidLine) // 去掉换行符和多余空格
+		if readErr == io.EOF {
+			break
+		}
+		if cidLine != "" {
+			cidList = append(cidList, cidLine) // 添加到 CID 列表
+		}
+	}
 
-    if len(cidList) == 0 {
-        fmt.Println("CID 文件中没有有效的 CID")
-        return
-    }
-    fmt.Printf("Total CIDs: %d\n", len(cidList))
+	if len(cidList) == 0 {
+		fmt.Println("no valid CID in the CID file")
+		return
+	}
+	fmt.Printf("Total CIDs: %d\n", len(cidList))
 
-    // 用于累加所有请求的执行时间
-    var totalDuration time.Duration
-    var totalRequests int
+	// 用于累加所有请求的执行时间
+	var totalDuration time.Duration
+	var totalRequests int
+	var mu sync.Mutex
 
-    var wg sync.WaitGroup
-    ticker := time.NewTicker(time.Second) // 定时器控制每秒发起的 FindProviders 请求数
-    done := make(chan struct{})           // 用于主线程的等待
-    var once sync.Once                    // 用于确保只关闭 done 通道一次
+	var wg sync.WaitGroup
+	ticker := time.NewTicker(time.Second) // 定时器控制每秒发起的 FindProviders 请求数
+	done := make(chan struct{})           // 用于主线程的等待
+	var once sync.Once                    // 用于确保只关闭 done 通道一次
 
 	// 捕捉退出信号
-    quit := make(chan os.Signal, 1)
-    signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 
+	// FindProviders 请求的函数
+	findProvidersFunc := func(cidStr string, index int) {
+		defer wg.Done() // 请求完成后减少 WaitGroup 计数
+		// fmt.Printf("Requesting CID: %s\n", cidStr)
 
-    // FindProviders 请求的函数
-    findProvidersFunc := func(cidStr string, index int) {
-        defer wg.Done() // 请求完成后减少 WaitGroup 计数
-        // fmt.Printf("Requesting CID: %s\n", cidStr)
+		ctx, col := metrics.WithCollector(ctx)
+		defer col.Discard()
+		// 记录开始时间
+		start := time.Now()
 
-        // 记录开始时间
-        start := time.Now()
+		// 解析 CID
+		p := icorepath.New(cidStr)
 
-        // 解析 CID
-        p := icorepath.New(cidStr)
+		// 调用 FindProviders 接口，传递可变参数列表形式的选项
+		pchan, err := ipfs.Dht().FindProviders(ctx, p, options.Dht.NumProviders(numProviders))
+		if err != nil {
+			results.Op(OpRecord{Op: "findprovider", Worker: index, CID: cidStr, Start: start, Error: err.Error()})
+			fmt.Printf("FindProviders request %d failed: %v\n", index, err)
+			return
+		}
 
-        // 调用 FindProviders 接口，传递可变参数列表形式的选项
-        pchan, err := ipfs.Dht().FindProviders(ctx, p, options.Dht.NumProviders(numProviders))
-        if err != nil {
-            fmt.Printf("FindProviders 请求 %d 时出错: %v\n", index, err)
-            return
-        }
+		// 处理查找到的提供者信息
+		foundProviders := 0
+		for provider := range pchan {
+			provider.ID.Pretty() // 模拟处理
+			foundProviders++
+		}
 
-        // 处理查找到的提供者信息
-        foundProviders := 0
-        for provider := range pchan {
-            provider.ID.Pretty() // 模拟处理
-            foundProviders++
-        }
+		// 记录结束时间
+		duration := time.Since(start)
+		results.Op(OpRecord{Op: "findprovider", Worker: index, CID: cidStr, Start: start, Providers: foundProviders, Peers: connectedPeers(ctx, ipfs)})
+		// lookups that overlapped with another one have no tree of their own
+		if !col.Overlapped() {
+			if err := lookupTrees.Write(col.FP, cidStr); err != nil {
+				fmt.Printf("failed to write the lookup trees of %s: %s\n", cidStr, err.Error())
+			}
+		}
 
-        // 记录结束时间
-        duration := time.Since(start)
+		// 累加执行时间
+		if phases.Measured(start) {
+			mu.Lock()
+			totalDuration += duration
+			totalRequests++
+			mu.Unlock()
+		}
+		// fmt.Printf("Request for CID %s finished, took %.2f ms\n", cidStr, duration.Seconds()*1000)
+	}
 
-        // 累加执行时间
-        totalDuration += duration
-        totalRequests++
-        // fmt.Printf("Request for CID %s finished, took %.2f ms\n", cidStr, duration.Seconds()*1000)
-    }
+	// 启动定时器，控制每秒发起 qps 个 FindProviders 请求
+	go func() {
+		waitingForCompletion := false // 引入标志位，防止重复创建等待线程
+
+		for {
+			select {
+			case <-ticker.C:
+				// 收集平均时间并输出
+				mu.Lock()
+				if totalRequests > 0 {
+					averageTime := totalDuration.Seconds() * 1000 / float64(totalRequests)
+					fmt.Printf("Average Time: %.2f ms, totalCount: %d, cidlist: %d\n", averageTime, totalRequests, len(cidList))
+				} else {
+					fmt.Println("No requests made yet.")
+				}
+				mu.Unlock()
+
+				// 处理 CID 列表中的 CID
+				if len(cidList) > 0 {
+					for i := 0; i < qps && len(cidList) > 0; i++ {
+						if !phases.Next() {
+							// measurement window is over, let the outstanding requests finish
+							cidList = nil
+							break
+						}
+						cidStr := cidList[0]
+						cidList = cidList[1:] // 移除第一个 CID
+						wg.Add(1)
+						go findProvidersFunc(cidStr, i)
+					}
+				}
 
-     // 启动定时器，控制每秒发起 qps 个 FindProviders 请求
-    go func() {
-        waitingForCompletion := false // 引入标志位，防止重复创建等待线程
-
-        for {
-            select {
-            case <-ticker.C:
-                // 收集平均时间并输出
-                if totalRequests > 0 {
-                    averageTime := totalDuration.Seconds() * 1000 / float64(totalRequests)
-                    fmt.Printf("Average Time: %.2f ms, totalCount: %d, cidlist: %d\n", averageTime, totalRequests, len(cidList))
-                } else {
-                    fmt.Println("No requests made yet.")
-                }
-
-                // 处理 CID 列表中的 CID
-                if len(cidList) > 0 {
-                    for i := 0; i < qps && len(cidList) > 0; i++ {
-                        cidStr := cidList[0]
-                        cidList = cidList[1:] // 移除第一个 CID
-                        wg.Add(1)
-                        go findProvidersFunc(cidStr, i)
-                    }
-                }
-
-                // 当 cidList 为空时，只启动一次等待 Goroutine
-                if len(cidList) == 0 && !waitingForCompletion {
-                    waitingForCompletion = true
-                    fmt.Println("All requests have been sent, waiting for completion...")
-
-                    go func() {
-                        wg.Wait() // 等待所有 Goroutine 完成
-                        fmt.Println("All requests completed.")
-                        once.Do(func() {
-                            close(done) // 确保只关闭一次
-                        })
-                    }()
-                }
+				// 当 cidList 为空时，只启动一次等待 Goroutine
+				if len(cidList) == 0 && !waitingForCompletion {
+					waitingForCompletion = true
+					fmt.Println("All requests have been sent, waiting for completion...")
+
+					go func() {
+						wg.Wait() // 等待所有 Goroutine 完成
+						fmt.Println("All requests completed.")
+						once.Do(func() {
+							close(done) // 确保只关闭一次
+						})
+					}()
+				}
 
 			case <-quit: // 捕捉到退出信号时执行
-                fmt.Println("Received interrupt signal, exiting immediately...")
-                ticker.Stop() // 停止定时器
-                once.Do(func() {
-                    close(done) // 确保只关闭一次
-                })
-                return
-            }
-        }
-    }()
-	
+				fmt.Println("Received interrupt signal, exiting immediately...")
+				ticker.Stop() // 停止定时器
+				once.Do(func() {
+					close(done) // 确保只关闭一次
+				})
+				return
+			}
+		}
+	}()
 
-    <-done // 主线程等待，直到所有请求完成
+	<-done // 主线程等待，直到所有请求完成
 
-    // 计算平均执行时间
-    if totalRequests > 0 {
-        avgDuration := totalDuration.Seconds()*1000 / float64(totalRequests)
-        fmt.Printf("所有 FindProviders 请求已完成，平均执行时间: %v ms\n", avgDuration)
-    } else {
-        fmt.Println("没有完成任何请求")
-    }
+	results.Summary()
+	// 计算平均执行时间
+	mu.Lock()
+	defer mu.Unlock()
+	if totalRequests > 0 {
+		avgDuration := totalDuration.Seconds() * 1000 / float64(totalRequests)
+		fmt.Printf("All FindProviders requests completed, average time: %v ms\n", avgDuration)
+	} else {
+		fmt.Println("No request completed")
+	}
 }
 
 
-
-
 func TraceUpload(index int, servers int, trace_docs string, chunker string, ipfs icore.CoreAPI, ctx context.Context) {
 	// in trace workload simulation, we no longer do manually provide, those are all left to original mechanism handle
 	metrics.CMD_CloseBackProvide = false
@@ -694,10 +831,14 @@ func TraceUpload(index int, servers int, trace_docs string, chunker string, ipfs
 			if i%servers == index {
 				// generate random file and save it as temp
 				size := sizes[i]
-				content := NewLenChars(size, StdChars)
+				content, err := contentGen.Generate(i, size)
+				if err != nil {
+					fmt.Println(err.Error())
+					return
+				}
 				inputpath := tempDir + "/temp"
 				//s := time.Now()
-				err = ioutil.WriteFile(inputpath, []byte(content), 0666)
+				err = ioutil.WriteFile(inputpath, content, 0666)
 				if err != nil {
 					fmt.Println(err.Error())
 					return
@@ -705,7 +846,15 @@ func TraceUpload(index int, servers int, trace_docs string, chunker string, ipfs
 				//fmt.Printf("WriteFile %f\n", time.Now().Sub(s).Seconds())
 
 				// put to ipfs store and background provide
+				start := time.Now()
 				cid, err := UploadFile(inputpath, ctx, ipfs, chunker, false)
+				if err != nil {
+					results.Op(OpRecord{Op: "upload", Size: int64(size), Start: start, Error: err.Error()})
+					fmt.Println(err.Error())
+					return
+				}
+				results.Op(OpRecord{Op: "upload", CID: cid.Cid().String(), Size: int64(size), Start: start})
+				manifest.Add(cid.Cid().String(), content)
 				// record file cid
 				outline := fmt.Sprintf("%d\t%s\n", names[i], strings.Split(cid.String(), "/")[2])
 				_, err = io.WriteString(cidFile, outline)
@@ -721,6 +870,7 @@ func TraceUpload(index int, servers int, trace_docs string, chunker string, ipfs
 		}
 		cidFile.Close()
 		fmt.Println("finished uploading")
+		results.Summary()
 		// stall after uploading all files until receive os signal of interrupt
 		sigChan := make(chan os.Signal)
 		signal.Notify(sigChan, os.Interrupt, os.Kill, syscall.SIGTERM)
@@ -731,7 +881,7 @@ func TraceUpload(index int, servers int, trace_docs string, chunker string, ipfs
 
 }
 
-func TraceDownload(traceFile string, traceDownload_randomRequest bool, ipfs icore.CoreAPI, ctx context.Context, pag bool, downloadNumber int) {
+func TraceDownload(traceFile string, traceDownload_randomRequest bool, ipfs icore.CoreAPI, ctx context.Context, pag bool, downloadNumber int, workers int, arrival *ArrivalProcess) {
 	metrics.CMD_CloseBackProvide = false
 
 	//use different metrics, because monitor/FPMonitor those are too detailed and expensive, here we no longer need to track them
@@ -773,11 +923,22 @@ func TraceDownload(traceFile string, traceDownload_randomRequest bool, ipfs icor
 		// load workload requests
 		scanner = bufio.NewScanner(traces)
 		var names []string
+		var times []float64
 
+		traceTimed := arrival != nil && arrival.Kind == "trace"
 		for scanner.Scan() {
 			line := scanner.Text()
 			codes := strings.Split(line, "\t")
 			names = append(names, codes[1])
+			// the first column is the time of the request, only used by trace-timed arrivals
+			if traceTimed {
+				t, err := strconv.ParseFloat(codes[0], 64)
+				if err != nil {
+					fmt.Printf("request %d of %s has no valid timestamp: %s\n", len(names), traces.Name(), err.Error())
+					return
+				}
+				times = append(times, t)
+			}
 		}
 		if err := scanner.Err(); err != nil {
 			fmt.Printf("Cannot scanner text file: %s, err: [%v]\n", traces.Name(), err)
@@ -785,10 +946,22 @@ func TraceDownload(traceFile string, traceDownload_randomRequest bool, ipfs icor
 		}
 		traces.Close()
 
-		//randomize request order
+		//randomize request order, every request keeps its timestamp
 		if traceDownload_randomRequest {
 			fmt.Println("randomizing request queue")
-			names = Shuffle(names)
+			perm := seededRand("shuffle", 0).Perm(len(names))
+			shuffledNames := make([]string, len(names))
+			for i, randIndex := range perm {
+				shuffledNames[i] = names[randIndex]
+			}
+			if traceTimed {
+				shuffledTimes := make([]float64, len(times))
+				for i, randIndex := range perm {
+					shuffledTimes[i] = times[randIndex]
+				}
+				times = shuffledTimes
+			}
+			names = shuffledNames
 		}
 
 		//download according to requests
@@ -796,33 +969,62 @@ func TraceDownload(traceFile string, traceDownload_randomRequest bool, ipfs icor
 		if downloadNumber != 0 {
 			n = downloadNumber
 		}
+		if traceTimed && traceDownload_randomRequest && n <= len(names) {
+			// the randomly chosen requests arrive in the order of their timestamps
+			order := make([]int, n)
+			for i := range order {
+				order[i] = i
+			}
+			sort.SliceStable(order, func(i, j int) bool { return times[order[i]] < times[order[j]] })
+			sortedNames, sortedTimes := make([]string, n), make([]float64, n)
+			for i, k := range order {
+				sortedNames[i], sortedTimes[i] = names[k], times[k]
+			}
+			names, times = sortedNames, sortedTimes
+		}
 		startTime := time.Now()
-		for i := 0; i < n; i++ {
+		get := func(i int, arrived time.Time) {
 			toRequest := ItemCid[names[i]]
 			p := icorepath.New(toRequest)
+			ctx, col := metrics.WithCollector(ctx)
+			defer col.Discard()
 			start := time.Now()
-			metrics.BDMonitor.GetStartTime = start
+			if metrics.CMD_EnableMetrics {
+				col.Monitor.GetStartTime = start
+			}
 			rootNode, err := ipfs.Unixfs().Get(ctx, p)
 			metrics.GetNode.UpdateSince(start)
 			startWrite := time.Now()
 			if err != nil {
-				panic(fmt.Errorf("could not get file with CID: %s", err))
+				results.Op(OpRecord{Op: "get", CID: toRequest, Arrival: arrived, Start: start, Error: err.Error()})
+				fmt.Printf("could not get file with CID %s: %s\n", toRequest, err.Error())
+				return
 			}
-			err = files.WriteTo(rootNode, downloadfilepath+"/"+names[i])
-
+			size, _ := rootNode.Size()
+			consumed, err := sink.Consume(rootNode, downloadfilepath+"/"+names[i])
 			if err != nil {
-				panic(fmt.Errorf("could not write out the fetched CID: %s", err))
+				results.Op(OpRecord{Op: "get", CID: toRequest, Size: size, Arrival: arrived, Start: start, Error: err.Error()})
+				fmt.Printf("could not write out the fetched CID %s: %s\n", toRequest, err.Error())
+				return
 			}
-			size, _ := rootNode.Size()
+			finish := time.Now()
+			verified, err := verifier.Verify(ctx, ipfs, toRequest, downloadfilepath+"/"+names[i], consumed.Sha256)
+			if err != nil {
+				fmt.Println(err.Error())
+			}
+			results.Op(withTimeline(OpRecord{Op: "get", CID: toRequest, Size: size, Arrival: arrived, Start: start, End: finish, Error: errString(err), Verify: verified, Providers: col.Monitor.Senders()}, col, consumed.FirstByte))
+			metrics.DownloadedLock.Lock()
 			metrics.DownloadedFileSize = append(metrics.DownloadedFileSize, int(size))
 			metrics.AvgDownloadLatency.UpdateSince(start)
 			metrics.ALL_DownloadedFileSize = append(metrics.ALL_DownloadedFileSize, int(size))
 			metrics.ALL_AvgDownloadLatency.UpdateSince(start)
+			metrics.DownloadedLock.Unlock()
 
 			metrics.WriteTo.UpdateSince(startWrite)
-			metrics.BDMonitor.GetFinishTime = time.Now()
-			metrics.CollectMonitor()
-			metrics.FPMonitor.CollectFPMonitor()
+			if metrics.CMD_EnableMetrics {
+				col.Monitor.GetFinishTime = time.Now()
+			}
+			col.Collect()
 
 			if pag {
 				cid, err := cid.Parse(toRequest)
@@ -835,16 +1037,40 @@ func TraceDownload(traceFile string, traceDownload_randomRequest bool, ipfs icor
 				}
 			}
 		}
+		if arrival != nil {
+			offsets, err := arrival.Offsets(n, times)
+			if err != nil {
+				fmt.Println(err.Error())
+				return
+			}
+			if workers < 1 {
+				workers = 1
+			}
+			arrival.Run(offsets, workers, func(worker, i int, arrived time.Time) bool {
+				get(i, arrived)
+				return true
+			})
+		} else {
+			for i := 0; i < n; i++ {
+				get(i, time.Time{})
+			}
+		}
 		totalsize := 0
+		metrics.DownloadedLock.Lock()
 		for _, s := range metrics.ALL_DownloadedFileSize {
 			totalsize += s
 		}
+		metrics.DownloadedLock.Unlock()
 		throughput := float64(totalsize) / 1024 / 1024 / (time.Now().Sub(startTime).Seconds())
-		line := fmt.Sprintf("%s %f %d %f %f\n", time.Now().String(), throughput, metrics.ALL_AvgDownloadLatency.Count(), metrics.ALL_AvgDownloadLatency.Mean()/1000000, metrics.ALL_AvgDownloadLatency.Percentile(float64(metrics.ALL_AvgDownloadLatency.Count())*0.99)/1000000)
+		results.Summary()
+		line := fmt.Sprintf("%s %f %d %f %f\n", time.Now().String(), throughput, metrics.ALL_AvgDownloadLatency.Count(), metrics.ALL_AvgDownloadLatency.Mean()/1000000, metrics.ALL_AvgDownloadLatency.Percentile(0.99)/1000000)
 		fmt.Println(line)
 	}
 }
 
+// backendFiles counts the files generated by ipfsbackend, for their content streams
+var backendFiles int64
+
 func handleRequest(conn net.Conn, ctx context.Context, ipfs icore.CoreAPI) {
 
 	request := make([]byte, 1024)
@@ -875,7 +1101,7 @@ func handleRequest(conn net.Conn, ctx context.Context, ipfs icore.CoreAPI) {
 			break
 		}
 		defer tmpFile.Close()
-		subs := NewLenChars(file_size, StdChars)
+		subs := NewLenChars(file_size, StdChars, seededRand("backend", int(atomic.AddInt64(&backendFiles, 1))))
 		// ioutil.WriteFile(tmpFile.Name(), []byte(subs), 0666)
 		_, err = tmpFile.WriteString((subs))
 		if err != nil {
@@ -885,11 +1111,13 @@ func handleRequest(conn net.Conn, ctx context.Context, ipfs icore.CoreAPI) {
 		}
 		//upload file to ipfs
 		cid, err := UploadFile(tmpFile.Name(), ctx, ipfs, "size-262144", metrics.CMD_ProvideEach)
+		results.Op(OpRecord{Op: "upload", CID: cidString(cid), Size: int64(file_size), Start: start, Error: errString(err)})
 		if err != nil {
 			fmt.Println(err.Error())
 			rep = "1 "
 			break
 		} else {
+			manifest.Add(cid.Cid().String(), []byte(subs))
 			cid_outline := strings.Split(cid.String(), "/")[2]
 			rep = "0 " + cid_outline + " "
 			fmt.Printf("%s upload %f ms\n", cid.Cid(), time.Now().Sub(start).Seconds()*1000)
@@ -909,16 +1137,27 @@ func handleRequest(conn net.Conn, ctx context.Context, ipfs icore.CoreAPI) {
 		cid := reqs[1]
 		cid = strings.Replace(cid, "\x00", "", -1)
 		p := icorepath.New(cid)
+		ctx, col := metrics.WithCollector(ctx)
+		defer col.Discard()
 		rootNode, err := ipfs.Unixfs().Get(ctx, p)
 		if err != nil {
+			results.Op(OpRecord{Op: "get", CID: cid, Start: start, Error: err.Error()})
 			fmt.Printf("error while get %s: %s\n", cid, err.Error())
 			rep = "1 "
 			break
 		} else {
 			rootget := time.Now()
-			err = files.WriteTo(rootNode, "output_tmp_file")
+			consumed, err := sink.Consume(rootNode, "output_tmp_file")
+			size, _ := rootNode.Size()
+			finish := time.Now()
+			verified := ""
 			if err != nil {
 				fmt.Printf("error while write to file %s : %s\n", cid, err.Error())
+			} else if verified, err = verifier.Verify(ctx, ipfs, cid, "output_tmp_file", consumed.Sha256); err != nil {
+				fmt.Println(err.Error())
+			}
+			results.Op(withTimeline(OpRecord{Op: "get", CID: cid, Size: size, Start: start, End: finish, Error: errString(err), Verify: verified, Peers: connectedPeers(ctx, ipfs)}, col, consumed.FirstByte))
+			if err != nil {
 				rep = "1 "
 				break
 			}
@@ -982,9 +1221,10 @@ func ipfs_backend(ctx context.Context, ipfs icore.CoreAPI) {
 	}()
 	sig := <-sigChan
 	fmt.Printf("Received signal: %v\n", sig)
+	results.Summary()
 }
 
-func UploadQPS(qps int, size, number int, ctx context.Context, ipfs icore.CoreAPI, cids string, redun int, chunker string, reGenerate bool) {
+func UploadQPS(qps int, size, number int, ctx context.Context, ipfs icore.CoreAPI, cids string, chunker string, reGenerate bool) {
 	cidFile, err := os.Create(cids)
 	if err != nil {
 		fmt.Printf("Failed to create CID file: %v", err)
@@ -1011,6 +1251,7 @@ func UploadQPS(qps int, size, number int, ctx context.Context, ipfs icore.CoreAP
 	var mu sync.Mutex // 保护并发操作的锁
 	cidsList := make([]string, 0)
 	var uploadedFiles int
+	var issuedFiles int // index of the next file, uploads of one tick run concurrently
 	startTime := time.Now() // 记录上传开始时间
 
 	var wg sync.WaitGroup
@@ -1018,7 +1259,12 @@ func UploadQPS(qps int, size, number int, ctx context.Context, ipfs icore.CoreAP
 	sendFunc := func(i int) {
 		defer wg.Done()
 		// 在上传前生成随机文件数据
-		fileContent := NewLenChars(size, StdChars) // 动态生成指定大小的随机数据
+		fileContent, err := contentGen.Generate(i, size) // 动态生成指定大小的随机数据
+		if err != nil {
+			fmt.Printf("Error generating file %d: %v\n", i, err)
+			stallChan <- i
+			return
+		}
 		start := time.Now()
 		// 直接上传内存中的数据，而不需要保存到磁盘
 		opts := []options.UnixfsAddOption{
@@ -1028,18 +1274,23 @@ func UploadQPS(qps int, size, number int, ctx context.Context, ipfs icore.CoreAP
 			opts = append(opts, options.Unixfs.ProvideThrough())
 		}
 
-		cid, err := ipfs.Unixfs().Add(ctx, files.NewBytesFile([]byte(fileContent)), opts...)
+		cid, err := ipfs.Unixfs().Add(ctx, files.NewBytesFile(fileContent), opts...)
 		if err != nil {
+			results.Op(OpRecord{Op: "upload", Worker: i, Size: int64(size), Start: start, Error: err.Error()})
 			fmt.Printf("Error uploading file %d: %v\n", i, err)
 			stallChan <- i
 			return
 		}
 
 		finish := time.Now()
+		results.Op(OpRecord{Op: "upload", Worker: i, CID: cid.Cid().String(), Size: int64(size), Start: start, End: finish})
+		manifest.Add(cid.Cid().String(), fileContent)
 		uploadTime := finish.Sub(start).Seconds() * 1000
 
 		mu.Lock()
-		totalUploadTime += uploadTime
+		if phases.Measured(start) {
+			totalUploadTime += uploadTime
+		}
 		cidsList = append(cidsList, cid.String())
 		uploadedFiles++
 		mu.Unlock()
@@ -1071,9 +1322,17 @@ func UploadQPS(qps int, size, number int, ctx context.Context, ipfs icore.CoreAP
 
 			fmt.Printf("Average upload time: %.2f ms, Throughput: %d files/sec\n", averageUploadTime, throughput)
 
-			for i := 0; i < qps && uploadedFiles < totalFiles; i++ {
+			for i := 0; i < qps && issuedFiles < totalFiles; i++ {
+				if !phases.Next() {
+					// measurement window is over, stop once the running uploads are done
+					mu.Lock()
+					totalFiles = issuedFiles
+					mu.Unlock()
+					break
+				}
 				wg.Add(1)
-				go sendFunc(uploadedFiles) // 直接启动 goroutine 进行上传
+				go sendFunc(issuedFiles) // 直接启动 goroutine 进行上传
+				issuedFiles++
 			}
 			if uploadedFiles >= totalFiles {
 				ticker.Stop()
@@ -1097,6 +1356,7 @@ func UploadQPS(qps int, size, number int, ctx context.Context, ipfs icore.CoreAP
 
 			fmt.Printf("All files uploaded. Average upload time: %.2f ms\n", averageUploadTime)
 			fmt.Printf("Total time: %.2f seconds, Average throughput: %.2f files/sec\n", totalTime, averageThroughput)
+			results.Summary()
 			return
 		}
 	}
@@ -1135,38 +1395,21 @@ func NewFullNode(ipfs icore.CoreAPI, ctx context.Context, config *Config) *FullN
     }
 }
 
-func (fn *FullNode) createBlock(kiloBytes float64) []byte { 
+func (fn *FullNode) createBlock(index int, kiloBytes float64) []byte { 
 	blockSize := kiloBytes * 1024
 	// round the blocksize to integer
 
 	block := make([]byte, int(math.Round(float64(blockSize))))
 
 	// 随机填充区块内容
-	rand.Read(block)
+	seededRand("block", index).Read(block)
 	return block
 }
 
 // 上传区块到IPFS，返回CID
 func (fn *FullNode) uploadBlockToIPFS(block []byte) (string, error) {
-	defer func(){
-		if metrics.CMD_EnableMetrics {
-			metrics.AddTimer.Update(metrics.AddDura)
-			metrics.Provide.Update(metrics.ProvideDura)
-			metrics.Persist.Update(metrics.PersistDura)
-
-			dagTime := metrics.AddDura - metrics.ProvideDura - metrics.PersistDura
-			metrics.Dag.Update(dagTime)
-
-			metrics.FlatfsHasTimer.Update(metrics.FlatfsHasDura)
-			metrics.FlatfsPut.Update(metrics.FlatfsPutDura)
-
-			metrics.FlatfsPutDura = 0
-			metrics.FlatfsHasDura = 0
-			metrics.AddDura = 0
-			metrics.ProvideDura = 0
-			metrics.PersistDura = 0
-		}
-	}()
+	ctx, col := metrics.WithCollector(fn.ctx)
+	defer col.Collect()
 	start := time.Now()
 	// 直接上传内存中的数据，而不需要保存到磁盘
 	opts := []options.UnixfsAddOption{
@@ -1175,7 +1418,7 @@ func (fn *FullNode) uploadBlockToIPFS(block []byte) (string, error) {
 	if metrics.CMD_ProvideEach {
 		opts = append(opts, options.Unixfs.ProvideThrough())
 	}
-	cid, err := fn.ipfs.Unixfs().Add(fn.ctx, files.NewBytesFile(block), opts...)
+	cid, err := fn.ipfs.Unixfs().Add(ctx, files.NewBytesFile(block), opts...)
 	// cid, err := fn.ipfs.Unixfs().Add(fn.ctx, files.NewBytesFile([]byte(block)), opts...)
 	if err != nil {
 		fmt.Printf("Error uploading file: %v\n", err)
@@ -1184,7 +1427,8 @@ func (fn *FullNode) uploadBlockToIPFS(block []byte) (string, error) {
 
 	// finish := time.Now()
 	// uploadTime := finish.Sub(start).Seconds() * 1000
-	metrics.AddDura += time.Now().Sub(start)
+	metrics.Record(ctx, metrics.StageAdd, time.Now().Sub(start))
+	manifest.Add(cid.Cid().String(), block)
 
 	return cid.Cid().String(), nil
 }
@@ -1209,8 +1453,11 @@ func (fn *FullNode) waitForLightNodeConfirmations() {
 				fmt.Println("Error reading from light node:", err)
 				return
 			}
-			if msg := string(buf[:n]); msg == "Confirmation" {
+			switch msg := strings.TrimSpace(string(buf[:n])); msg {
+			case "Confirmation":
 				fmt.Println("Received confirmation from light node")
+			case verifyFailedMessage:
+				fmt.Printf("Light node %s failed to verify the block\n", c.RemoteAddr())
 			}
 		}(conn) // 将当前的连接传递给 goroutine
 	}
@@ -1271,7 +1518,7 @@ func (fn *FullNode) run() {
 		start := time.Now() // 开始时间，用于计算延迟
 		// 在 goroutine 中执行阻塞操作 (上传区块)
 		go func(blockIndex int) {
-			block := fn.createBlock(fn.blocks[blockIndex])
+			block := fn.createBlock(blockIndex, fn.blocks[blockIndex])
 			fmt.Printf("%s: Generated block %d with size %.2f KB\n", time.Now().String(), blockIndex, fn.blocks[blockIndex])
 			cid, err := fn.uploadBlockToIPFS(block)
 			if err != nil {
@@ -1285,9 +1532,11 @@ func (fn *FullNode) run() {
 		case <-stop: // 如果收到中断信号，优雅退出
 			fmt.Println("Received interrupt signal. Shutting down full node...")
 			fn.shutdown() // 执行关闭操作
+			results.Summary()
 			return
 
 		case cid := <-cidChan: // 正常上传完成
+			results.Op(OpRecord{Op: "upload", CID: cid, Size: int64(math.Round(fn.blocks[i] * 1024)), Start: start})
 			fmt.Printf("%s: Uploaded block %d with CID %s\n", time.Now().String(), i, cid)
 			fn.broadcastCID(cid)
 			fmt.Printf("%s: Broadcasted CID to light nodes...\n", time.Now().String())
@@ -1301,6 +1550,7 @@ func (fn *FullNode) run() {
 			fmt.Printf("%s: Received confirmations from light nodes...\n", time.Now().String())
 
 		case err := <-errChan: // 处理上传过程中出现的错误
+			results.Op(OpRecord{Op: "upload", Size: int64(math.Round(fn.blocks[i] * 1024)), Start: start, Error: err.Error()})
 			fmt.Printf("Error uploading block: %v\n", err)
 		// case <-time.After(5 * time.Second): // 超时处理
 		// 	fmt.Printf("Timeout while uploading block %d.\n", i)
@@ -1583,21 +1833,25 @@ func (ln *LightNode) listenForBlocks() {
         case <-stop: // 收到中断信号时优雅退出
             fmt.Println("Received interrupt signal. Shutting down light node...")
             ln.shutdown() // 执行关闭操作
+            results.Summary()
             return
         case cid := <-cidChan: // 正常读取 CID
             fmt.Printf("Received CID: %s\n", cid)
             cid = strings.TrimSpace(cid)
             fmt.Printf("%s: Received CID from full node: %s\n", time.Now().String(), cid)
 
-            ctx_time, cancel := context.WithTimeout(ln.ctx, 60*time.Minute)
+            ctx_col, col := metrics.WithCollector(ln.ctx)
+            ctx_time, cancel := context.WithTimeout(ctx_col, 60*time.Minute)
             defer cancel()
             p := icorepath.New(cid)
             start := time.Now()
             if metrics.CMD_EnableMetrics {
-                metrics.BDMonitor.GetStartTime = start
+                col.Monitor.GetStartTime = start
             }
             rootNode, err := ln.ipfs.Unixfs().Get(ctx_time, p)
             if err != nil {
+                col.Discard()
+                results.Op(OpRecord{Op: "get", CID: cid, Start: start, Error: err.Error()})
                 fmt.Printf("error while get %s: %s\n", cid, err.Error())
                 continue
             }
@@ -1605,19 +1859,25 @@ func (ln *LightNode) listenForBlocks() {
                 metrics.GetNode.UpdateSince(start)
             }
             startWrite := time.Now()
-            err = files.WriteTo(rootNode, tempDir+"/"+cid)
+            consumed, err := sink.Consume(rootNode, tempDir+"/"+cid)
+            size, _ := rootNode.Size()
+            finish := time.Now()
             if err != nil {
+                col.Discard()
+                results.Op(OpRecord{Op: "get", CID: cid, Size: size, Start: start, End: finish, Error: err.Error(), Peers: connectedPeers(ln.ctx, ln.ipfs)})
                 fmt.Printf("error while write to file %s : %s\n", cid, err.Error())
                 continue
             }
+            verified, verr := verifier.Verify(ln.ctx, ln.ipfs, cid, tempDir+"/"+cid, consumed.Sha256)
+            results.Op(withTimeline(OpRecord{Op: "get", CID: cid, Size: size, Start: start, End: finish, Error: errString(verr), Verify: verified, Providers: col.Monitor.Senders(), Peers: connectedPeers(ln.ctx, ln.ipfs)}, col, consumed.FirstByte))
 			// fmt.Printf("%s: Got blocks for CID %s\n", time.Now().String(), cid)
             if metrics.CMD_EnableMetrics {
                 metrics.WriteTo.UpdateSince(startWrite)
-                metrics.BDMonitor.GetFinishTime = time.Now()
-                metrics.CollectMonitor()
-                metrics.FPMonitor.CollectFPMonitor()
+                col.Monitor.GetFinishTime = time.Now()
+                col.Collect()
             }
-            downTimer.UpdateSince(start)
+            col.Discard()
+            downTimer.Update(finish.Sub(start))
 			if len(disconnectNeighbours) != 0 {
 				for _, n := range disconnectNeighbours {
 					//fmt.Printf("try to disconnect from %s\n", n)
@@ -1628,7 +1888,17 @@ func (ln *LightNode) listenForBlocks() {
 				}
 			}
             // 验证区块
-            fmt.Printf("%s: Block verified. Sending confirmation to full node.\n", time.Now().String())
+            switch verified {
+            case VerifyOK:
+                fmt.Printf("%s: Block verified. Sending confirmation to full node.\n", time.Now().String())
+            case VerifyFailed:
+                // the full node waits for an answer of every light node, so the failure is reported instead
+                fmt.Printf("%s: Block verification failed: %s. Reporting the failure to full node.\n", time.Now().String(), verr.Error())
+                ln.sendMessage(verifyFailedMessage)
+                continue
+            default:
+                fmt.Printf("%s: Block received (not verified, see -verify). Sending confirmation to full node.\n", time.Now().String())
+            }
             ln.sendConfirmation()
         case err := <-errChan: // 处理读取错误
             fmt.Printf("Error reading CID: %v\n", err)
@@ -1639,12 +1909,18 @@ func (ln *LightNode) listenForBlocks() {
 // 发送确认消息给全节点
 // 发送确认消息给全节点
 func (ln *LightNode) sendConfirmation() {
-    confirmationMessage := "Confirmation"
-    _, err := fmt.Fprintf(ln.conn, "%s\n", confirmationMessage) // 发送确认消息
+    ln.sendMessage("Confirmation")
+}
+
+// verifyFailedMessage answers a block that failed -verify instead of the confirmation
+const verifyFailedMessage = "VerifyFailed"
+
+func (ln *LightNode) sendMessage(msg string) {
+    _, err := fmt.Fprintf(ln.conn, "%s\n", msg)
     if err != nil {
-        fmt.Printf("Error sending confirmation to full node: %v\n", err)
+        fmt.Printf("Error sending %s to full node: %v\n", msg, err)
     } else {
-        fmt.Printf("Sent confirmation to full node: %s\n", confirmationMessage)
+        fmt.Printf("Sent %s to full node\n", msg)
     }
 }
 func LightNodeMain(ipfs icore.CoreAPI, ctx context.Context, configFile string) {
@@ -1707,7 +1983,7 @@ func main() {
 	var qps int
 	var bitcoin_config_path string
 
-	flag.IntVar(&redun_rate, "redun", 0, "The redundancy of the file when Benchmarking upload, 100 indicates that there is exactly the same file in the node, 0 means there is no existence of same file.(default 0)")
+	flag.IntVar(&redun_rate, "redun", 0, "The redundancy of the file when Benchmarking upload, 100 indicates that there is exactly the same file in the node, 0 means there is no existence of same file.(default 0), short for -content prefix:<redun>")
 	flag.StringVar(&cmd, "c", "", "operation type\n"+
 		"upload: upload files to ipfs, with -s for file size, -n for file number, -p for concurrent upload threads, -cid for specified uploaded file cid stored\n"+
 		"downloads: download file following specified cid file with single thread, -pag provide file after get, -np path to the file of neighbours which will be disconnected after each get\n"+
@@ -1759,6 +2035,14 @@ func main() {
 		"Note that if enable pbitswap the metrics will be no longer accurate.")
 	flag.BoolVar(&(metrics.CMD_DisCoWorer), "discoworker", false, "whether to enable CoWorer")
 	flag.BoolVar(&(metrics.CMD_PBitswap_Ticker), "pbticker", false, "whether to enable pbitswap ticker which periodically queries providers. This it is beneficial when the number of providers is low in the network.")
+	flag.BoolVar(&(metrics.CMD_PBitswapBalance), "pbbalance", false, "whether to balance pbitswap requests by the measured throughput and RTT of each provider, "+
+		"fast providers get larger batches and take over pending blocks of slow ones")
+	flag.IntVar(&(metrics.CMD_PBitswapEndgame), "pbendgame", 0, "enter the pbitswap endgame once no more than this many blocks are missing: pending blocks are also requested from the fastest other providers "+
+		"and the losing requests cancelled. 0 disables the endgame")
+	flag.StringVar(&(metrics.CMD_PBitswapController), "pbcontroller", "ratio", "batch controller of each pbitswap worker: ratio, aimd, adjust5, adjust6 or bbr")
+	var schedulerList string
+	flag.StringVar(&schedulerList, "scheduler", "xor", "block-request scheduler of pbitswap: xor, roundrobin, rarest or sequential. "+
+		"A comma-separated list runs the downloads with each of them in turn, their results are summarized apart")
 
 	flag.Float64Var(&(metrics.B), "B", 0.95, "parameter for ax + by")
 
@@ -1769,16 +2053,261 @@ func main() {
 	flag.IntVar(&serach_provider_number, "spn", 1, "search provider number")
 	flag.StringVar(&bitcoin_config_path, "bc", "bitcoin_config", "path to bitcoin config file")
 
+	var arrivalKind string
+	var arrivalRate float64
+	flag.StringVar(&arrivalKind, "arrival", "closed", "request arrivals of downloads/traceDownload: closed (each worker waits for its previous get), or open-loop constant, poisson or trace (timestamps of the trace file)")
+	flag.Float64Var(&arrivalRate, "rate", 10, "requests per second of constant and poisson arrivals")
+
+	var warmup string
+	var duration time.Duration
+	flag.StringVar(&warmup, "warmup", "", "warmup of upload, downloads, findproviderqps and uploadqps that is not measured: a number of operations (e.g. 20) or a duration (e.g. 30s)")
+	var verifyMode string
+	var manifestPath string
+	flag.StringVar(&verifyMode, "verify", "", "verify every downloaded file after writing it: cid (re-import with -chunker and compare the root CID) or sha256 (compare with the manifest written by uploads run with -verify sha256)")
+	flag.StringVar(&manifestPath, "manifest", "", "sha256 manifest of uploaded content, default is the cid file name plus .sha256")
+
+	var rangeDist string
+	var rangeSize int64
+	var rangeCount int
+	flag.StringVar(&rangeDist, "rangedist", "uniform", "offsets of the reads of rangedownload: uniform, sequential, zipf or head")
+	flag.Int64Var(&rangeSize, "rangesize", 1024*1024, "bytes per read of rangedownload")
+	flag.IntVar(&rangeCount, "ranges", 8, "reads per file of rangedownload")
+
+	var sweepChunkers, sweepLayouts, sweepRawLeaves, sweepFiles string
+	flag.StringVar(&sweepChunkers, "chunkers", "size-262144,size-1048576,rabin-262144-524288-1048576,buzhash", "comma-separated chunkers chunksweep compares")
+	flag.StringVar(&sweepLayouts, "layouts", "balanced,trickle", "comma-separated DAG layouts chunksweep compares: balanced, trickle")
+	flag.StringVar(&sweepRawLeaves, "rawleaves", "false,true", "comma-separated raw-leaves settings chunksweep compares")
+	flag.StringVar(&sweepFiles, "sweepfiles", "", "comma-separated files and directories chunksweep adds as they are, instead of -n generated files of -s bytes")
+
+	var treeFanout, treeDepth int
+	var sizeDist, dirPath string
+	var hamtSharding bool
+	flag.IntVar(&treeFanout, "fanout", 4, "entries per directory of the trees of uploaddir and -dirpath")
+	flag.IntVar(&treeDepth, "depth", 1, "levels of subdirectories of the trees of uploaddir and -dirpath, 0 is one flat directory")
+	flag.StringVar(&sizeDist, "sizedist", "fixed", "file sizes in the trees of uploaddir: fixed (-s), uniform:<min>-<max> or lognormal:<median>:<sigma>, in bytes")
+	flag.StringVar(&dirPath, "dirpath", "", "what downloads fetches of each tree uploaded by uploaddir: the whole tree (default), all (every file on its own), random (one random file) or a path such as d0/f3")
+	flag.BoolVar(&hamtSharding, "sharding", false, "add directories as HAMT-sharded unixfs directories")
+
+	var contentSpec string
+	flag.StringVar(&contentSpec, "content", "text", "content of generated files: text, random, zero, dup:<pct> (pct percent of blocks repeat), prefix:<pct> (pct percent preloaded, like -redun) or dir:<path> (replay real files)")
+
+	var workloadSeedFlag int64
+	flag.Int64Var(&workloadSeedFlag, "seed", 0, "seed of all generated content, request shuffling, arrivals and netem draws, the same seed uploads the same files in the same order (0: draw one, it is recorded in the spec)")
+
+	var sinkMode string
+	flag.StringVar(&sinkMode, "sink", "disk", "where downloads go: disk (write to the output directory), discard (stream and drop) or hash (stream into SHA-256, works with -verify sha256)")
+
+	var reportInterval time.Duration
+	flag.DurationVar(&reportInterval, "interval", 10*time.Second, "length of the intervals of the throughput series printed by report")
+	flag.DurationVar(&duration, "duration", 0, "length of the measured steady state (e.g. 5m), after which no new operations start; 0 runs until the workload is exhausted")
+
+	var specPath string
+	var outFormat string
+	var outFile string
+	flag.StringVar(&outFormat, "out", "text", "result format: text keeps the plain log lines, json or csv additionally emit one record per operation plus a summary record")
+	flag.StringVar(&outFile, "outfile", "", "file to write json/csv result records to, default stdout")
+	var timelinePath string
+	var chromeTracePath string
+	var lookupTreeDir string
+	flag.StringVar(&lookupTreeDir, "lookuptree", "", "directory to write the DHT lookup tree of every provider lookup to, as Graphviz DOT per CID and as JSON lines in lookup.jsonl, needs -enablemetrics")
+	flag.StringVar(&chromeTracePath, "chrometrace", "", "file to write the block and DHT events of every get to in Chrome Trace Event Format, for Perfetto or chrome://tracing, needs -enablemetrics")
+	flag.StringVar(&timelinePath, "timeline", "", "file to write the per-block timeline of every get to as JSON lines, needs -enablemetrics")
+	var batchLogPath string
+	flag.StringVar(&batchLogPath, "batchlog", "", "file to write the batch size of every pbitswap worker over time to as JSON lines")
+	var metricsAddr string
+	var testnetNodes int
+	var testnetWorkload string
+	flag.IntVar(&testnetNodes, "nodes", 3, "number of in-process nodes of a testnet, the last one is the client and all others are providers")
+	var netemMatrix string
+	flag.StringVar(&netemMatrix, "netem", "", "matrix file of regions and per-pair latency, jitter, bandwidth and loss emulated between testnet nodes")
+	flag.StringVar(&testnetWorkload, "tnw", "downloads", "workload the testnet client runs after the providers uploaded files: downloads, findproviderqps or upload (providers only)")
+	flag.StringVar(&metricsAddr, "metricsaddr", "", "address (e.g. :9100) to expose all metrics in Prometheus text format at /metrics, disabled if empty")
+	flag.StringVar(&specPath, "spec", "", "path to an experiment spec file (YAML, or JSON with .json extension) holding the command and flags of this run, flags given on the command line override the spec")
+
 	flag.Parse()
 
+	if specPath != "" {
+		spec, err := loadSpec(specPath)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		if err := spec.apply(); err != nil {
+			fmt.Printf("failed to apply spec %s: %s\n", specPath, err.Error())
+			return
+		}
+	}
+	fmt.Printf("spec: %s\n", effectiveSpec())
+
+	// the forks record the events of concurrent operations into one monitor, which the per-operation outputs cannot split
+	if (timelinePath != "" || chromeTracePath != "" || lookupTreeDir != "") && (concurrentGet > 1 || parallel > 1) {
+		fmt.Println("-timeline, -chrometrace and -lookuptree record one operation at a time, they do not work with -cg > 1 or -p > 1")
+		return
+	}
+
+	rw, err := NewResultWriter(cmd, outFormat, outFile)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	results = rw
+	defer results.Close()
+	if timelinePath != "" {
+		if !metrics.CMD_EnableMetrics {
+			fmt.Println("-timeline only records gets with -enablemetrics")
+		}
+		tf, err := os.Create(timelinePath)
+		if err != nil {
+			fmt.Printf("failed to create timeline file: %s\n", err.Error())
+			return
+		}
+		defer tf.Close()
+		timeline = metrics.NewTimelineWriter(tf)
+	}
+	if batchLogPath != "" {
+		if !metrics.EnablePbitswap {
+			fmt.Println("-batchlog only records downloads with -enablepbitswap")
+		}
+		bf, err := os.Create(batchLogPath)
+		if err != nil {
+			fmt.Printf("failed to create batch log: %s\n", err.Error())
+			return
+		}
+		defer bf.Close()
+		metrics.BatchLog = metrics.NewBatchLogWriter(bf)
+	}
+	if chromeTracePath != "" {
+		if !metrics.CMD_EnableMetrics {
+			fmt.Println("-chrometrace only records gets with -enablemetrics")
+		}
+		tf, err := os.Create(chromeTracePath)
+		if err != nil {
+			fmt.Printf("failed to create trace file: %s\n", err.Error())
+			return
+		}
+		defer tf.Close()
+		chromeTrace = metrics.NewChromeTraceWriter(tf)
+		defer chromeTrace.Close()
+	}
+	if lookupTreeDir != "" {
+		if !metrics.CMD_EnableMetrics {
+			fmt.Println("-lookuptree only records lookups with -enablemetrics")
+		}
+		lookupTrees, err = metrics.NewLookupTreeWriter(lookupTreeDir)
+		if err != nil {
+			fmt.Printf("failed to create lookup tree directory: %s\n", err.Error())
+			return
+		}
+		defer lookupTrees.Close()
+	}
+	schedulers, err = metrics.ParseSchedulers(schedulerList)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	metrics.CMD_PBitswapScheduler = schedulers[0]
+	if !containsString(metrics.Controllers, metrics.CMD_PBitswapController) {
+		fmt.Printf("unknown pbitswap batch controller %q, expected one of %s\n", metrics.CMD_PBitswapController, strings.Join(metrics.Controllers, ", "))
+		return
+	}
+	// record the seed actually used, so the spec of the run reproduces it
+	flag.Set("seed", strconv.FormatInt(SetSeed(workloadSeedFlag), 10))
+	results.Spec(effectiveSpec())
+
+	arrival, err := NewArrivalProcess(arrivalKind, arrivalRate)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if arrival != nil && arrival.Kind == "trace" && cmd != "traceDownload" {
+		fmt.Println("-arrival trace takes the timestamps of the -f trace file, only traceDownload has one")
+		return
+	}
+	phases, err = ParsePhases(warmup, duration)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if redun_rate > 0 && redun_rate <= 100 {
+		if contentSpec != "text" {
+			fmt.Println("-redun is short for -content prefix:<redun>, give only one of them")
+			return
+		}
+		contentSpec = fmt.Sprintf("prefix:%d", redun_rate)
+	}
+	contentGen, err = NewContentGenerator(contentSpec, chunkerBlockSize(chunker))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if _, ok := contentGen.(preloader); ok && cmd != "upload" && cmd != "testnet" {
+		fmt.Printf("-content %s preloads data, which only upload supports\n", contentSpec)
+		return
+	}
+
+	if manifestPath == "" {
+		manifestPath = cidfile + ".sha256"
+	}
+	sink, err = NewSink(sinkMode)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	verifier, err = NewVerifier(verifyMode, chunker, manifestPath, sink)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if hamtSharding && verifyMode == "sha256" && sink.Mode == "hash" {
+		fmt.Println("-verify sha256 with -sink hash hashes a sharded directory in the order of its shards, use -sink disk")
+		return
+	}
+	uio.UseHAMTSharding = hamtSharding
+	if cmd == "uploaddir" || dirPath != "" {
+		sizes, err := ParseSizeDist(sizeDist, filesize)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		dirTree, err = NewDirTree(treeFanout, treeDepth, sizes, dirPath)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+	}
+	if cmd == "upload" || cmd == "uploadqps" || cmd == "uploaddir" || cmd == "testnet" || cmd == "traceUpload" || cmd == "ipfsbackend" || cmd == "fullnode" {
+		manifest, err = NewManifestWriter(verifyMode, manifestPath)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		defer manifest.Close()
+	}
+
+	if cmd == "report" {
+		// merges result files, no node needed
+		if err := Report(flag.Args(), reportInterval); err != nil {
+			fmt.Println(err.Error())
+		}
+		return
+	}
+
 	if metrics.EnablePbitswap {
 		fmt.Printf("pbitswap is enabled\n")
+		fmt.Printf("pbitswap schedulers: %s\n", strings.Join(schedulers, ", "))
+		fmt.Printf("pbitswap batch controller: %s\n", metrics.CMD_PBitswapController)
 		if metrics.CMD_DisCoWorer {
 			fmt.Printf("CoWorer is Disabled\n")
 		}
 		if metrics.CMD_PBitswap_Ticker {
 			fmt.Printf("PBitswap Ticker is Enabled\n")
 		}
+		if metrics.CMD_PBitswapBalance {
+			fmt.Printf("PBitswap load balancing is Enabled\n")
+		}
+		if metrics.CMD_PBitswapEndgame > 0 {
+			fmt.Printf("PBitswap endgame below %d blocks is Enabled\n", metrics.CMD_PBitswapEndgame)
+		}
 	}
 
 	// NOTE: check the concurrentGet.
@@ -1809,6 +2338,10 @@ func main() {
 		}()
 	}
 
+	if metricsAddr != "" {
+		metrics.StartMetricsServer(metricsAddr)
+	}
+
 	if metrics.CMD_PeerRH {
 		fmt.Println("PeerRH is enabled")
 		// 假设一个cacheline 需要 200 个字节，那么我们让最多设置 5e6 个 cacheline
@@ -1862,13 +2395,13 @@ func main() {
 
 		defer cancel()
 		// NOTE: I modified the function for adding a ** chunker ** .
-		Upload(filesize, filenumber, parallel, ctx, ipfs, cidfile, redun_rate, chunker, ReGenerateFile)
+		Upload(filesize, filenumber, parallel, ctx, ipfs, cidfile, chunker, ReGenerateFile)
 		return
 	}
 	if cmd == "downloads" {
 		ctx, ipfs, cancel := Ini()
 		defer cancel()
-		DownloadSerial(ctx, ipfs, cidfile, provideAfterGet, rmNeighbourPath, concurrentGet, stallafterdownload)
+		DownloadSerial(ctx, ipfs, cidfile, provideAfterGet, rmNeighbourPath, concurrentGet, stallafterdownload, arrival)
 		return
 	}
 	if cmd == "findproviderqps" {
@@ -1878,10 +2411,29 @@ func main() {
 		return 
 	}
 
+	if cmd == "rangedownload" {
+		spec, err := NewRangeSpec(rangeDist, rangeSize, rangeCount)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		ctx, ipfs, cancel := Ini()
+		defer cancel()
+		AddNeighbour(ipfs, ctx)
+		RangeDownload(ctx, ipfs, cidfile, spec)
+		return
+	}
+	if cmd == "uploaddir" {
+		ctx, ipfs, cancel := Ini()
+		defer cancel()
+		UploadDir(ctx, ipfs, dirTree, filenumber, cidfile, chunker)
+		return
+	}
+
 	if cmd == "uploadqps"{
 		ctx, ipfs, cancel := Ini()
 		defer cancel()
-		UploadQPS(qps, filesize, filenumber, ctx, ipfs, cidfile, redun_rate, chunker, ReGenerateFile)
+		UploadQPS(qps, filesize, filenumber, ctx, ipfs, cidfile, chunker, ReGenerateFile)
 		return
 	}
 	if cmd == "daemon" {
@@ -1920,7 +2472,7 @@ func main() {
 	if cmd == "traceDownload" {
 		ctx, ipfs, cancel := Ini()
 		defer cancel()
-		TraceDownload(traceFile, traceDownload_randomRequest, ipfs, ctx, provideAfterGet, downloadNumber)
+		TraceDownload(traceFile, traceDownload_randomRequest, ipfs, ctx, provideAfterGet, downloadNumber, concurrentGet, arrival)
 		return
 	}
 	if cmd == "ipfsbackend" {
@@ -1936,6 +2488,84 @@ func main() {
 		FullNodeMain(ipfs, ctx, bitcoin_config_path)
 		return
 	}
+	if cmd == "chunksweep" {
+		configs, err := SweepConfigs(sweepChunkers, sweepLayouts, sweepRawLeaves)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		var netem *NetemMatrix
+		if netemMatrix != "" {
+			netem, err = loadNetemMatrix(netemMatrix)
+			if err != nil {
+				fmt.Println(err.Error())
+				return
+			}
+		}
+		inputs, err := sweepInputs(sweepFiles, filesize, filenumber)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		if err := ChunkSweep(configs, inputs, netem); err != nil {
+			fmt.Println(err.Error())
+		}
+		return
+	}
+	if cmd == "testnet" {
+		if testnetNodes < 2 {
+			fmt.Println("a testnet needs at least 2 nodes")
+			return
+		}
+		var netem *NetemMatrix
+		if netemMatrix != "" {
+			var err error
+			netem, err = loadNetemMatrix(netemMatrix)
+			if err != nil {
+				fmt.Println(err.Error())
+				return
+			}
+		}
+		ctx, tn, cancel, err := StartTestnet(testnetNodes, netem)
+		if err != nil {
+			fmt.Printf("failed to start testnet: %s\n", err.Error())
+			return
+		}
+		defer cancel()
+		defer tn.Close()
+
+		// every provider adds the same generated files and announces them right away, nothing outside the testnet is
+		// there to disconnect from
+		metrics.CMD_StallAfterUpload = false
+		metrics.CMD_ProvideEach = true
+		disconnectNeighbours = nil
+		for i, n := range tn.Providers() {
+			fmt.Printf("provider node-%d uploading\n", i)
+			Upload(filesize, filenumber, parallel, ctx, n.API, cidfile, chunker, i == 0)
+		}
+
+		if verifier != nil && verifyMode == "sha256" {
+			// the manifest was only written by the uploads above
+			if err := verifier.loadManifest(manifestPath); err != nil {
+				fmt.Println(err.Error())
+				return
+			}
+		}
+		client := tn.Client().API
+		switch testnetWorkload {
+		case "downloads":
+			DownloadSerial(ctx, client, cidfile, provideAfterGet, rmNeighbourPath, concurrentGet, false, arrival)
+		case "findproviderqps":
+			FindProviderQPS(qps, ctx, client, cidfile, serach_provider_number)
+		case "upload":
+		default:
+			fmt.Printf("unknown testnet workload %s\n", testnetWorkload)
+		}
+		if err := tn.CheckNetem(ctx); err != nil {
+			fmt.Printf("testnet run failed: %s\n", err.Error())
+		}
+		return
+	}
 	if cmd=="lightnode"{
 		fmt.Println("lightnode")
 		ctx, ipfs, cancel := Ini()
@@ -1955,7 +2585,8 @@ func main() {
 var StdChars = []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789")
 
 // NewLenChars returns a new random string of the provided length, consisting of the provided byte slice of allowed characters(maximum 256).
-func NewLenChars(length int, chars []byte) string {
+// The random bytes come from rng, so the same stream gives the same string.
+func NewLenChars(length int, chars []byte, rng *rand.Rand) string {
 	if length == 0 {
 		return ""
 	}
@@ -1968,7 +2599,7 @@ func NewLenChars(length int, chars []byte) string {
 	r := make([]byte, length+(length/4)) // storage for random bytes.
 	i := 0
 	for {
-		if _, err := rand.Read(r); err != nil {
+		if _, err := rng.Read(r); err != nil {
 			panic("Error reading random bytes: " + err.Error())
 		}
 		for _, rb := range r {
@@ -2046,17 +2677,7 @@ func DisconnectAllPeers(ctx context.Context, ipfs icore.CoreAPI, remove string)
 }
 
 func Shuffle(vals []string) []string {
-	interfaces, _ := net.Interfaces()
-	mac := int64(0)
-	for _, i := range interfaces {
-		//fmt.Println(len(i.HardwareAddr))
-		if ha := i.HardwareAddr; len(ha) > 0 {
-			ha = append(ha, 8)
-			ha = append(ha, 9)
-			mac += BytesToInt64(ha)
-		}
-	}
-	r := rand.New(rand.NewSource(time.Now().Unix() + mac))
+	r := seededRand("shuffle", 0)
 	ret := make([]string, len(vals))
 	perm := r.Perm(len(vals))
 	for i, randIndex := range perm {
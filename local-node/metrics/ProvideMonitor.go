@@ -3,12 +3,10 @@ package metrics
 import (
 	"fmt"
 	"time"
-
-	"github.com/rcrowley/go-metrics"
 )
 
 //Provide metrics
-var ProvideTime metrics.Timer
+var ProvideTime *LatencyHistogram
 var SuccessfullyProvide int
 var StartBackProvideTime time.Time
 var LastFewProvides *Queue //record the Min CPL in top K peers for last a few provides
@@ -33,7 +31,7 @@ func Output_ProvideMonitor() {
 	}
 
 	fmt.Println("--------------------------DHT.Provide----------------------")
-	fmt.Printf("ProvideLatency: %d ,     avg- %f ms, 0.9p- %f ms \n", ProvideTime.Count(), ProvideTime.Mean()/MS, ProvideTime.Percentile(float64(ProvideTime.Count())*0.9)/MS)
+	fmt.Printf("ProvideLatency: %d ,     avg- %f ms, 0.9p- %f ms \n", ProvideTime.Count(), ProvideTime.Mean()/MS, ProvideTime.Percentile(0.9)/MS)
 	fmt.Printf("ProvideThroughput: %f /min\n", float64(SuccessfullyProvide)/(time.Now().Sub(StartBackProvideTime).Seconds()/60))
 }
 
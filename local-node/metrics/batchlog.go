@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// Controllers are the names of the batch controllers of pbitswap.
+var Controllers = []string{"ratio", "aimd", "adjust5", "adjust6", "bbr"}
+
+// CMD_PBitswapController is the batch controller of every pbitswap worker.
+var CMD_PBitswapController = "ratio"
+
+// BatchSize is the batch size of a pbitswap worker at one point of a download: when the worker started (init), after a
+// block changed it (block), after the download discovered more blocks of the DAG (grow), and after every batch the
+// worker completed (batch), which carries the measurements of the batch. Times are milliseconds since the download
+// started.
+type BatchSize struct {
+	Record     string  `json:"record"`
+	Download   string  `json:"download"`
+	Worker     string  `json:"worker"`
+	Controller string  `json:"controller"`
+	Event      string  `json:"event"`
+	Ms         float64 `json:"ms"`
+	Batch      int     `json:"batch"`
+	Requested  int     `json:"requested,omitempty"`
+	Received   int     `json:"received,omitempty"`
+	Redundant  int     `json:"redundant,omitempty"`
+	RTTMs      float64 `json:"rtt_ms,omitempty"`
+	ElapsedMs  float64 `json:"elapsed_ms,omitempty"`
+}
+
+// BatchLog receives the batch sizes of every pbitswap worker if -batchlog is set.
+var BatchLog *BatchLogWriter
+
+// BatchLogWriter writes the batch sizes of pbitswap workers to one JSON lines file.
+type BatchLogWriter struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+func NewBatchLogWriter(w io.Writer) *BatchLogWriter {
+	return &BatchLogWriter{enc: json.NewEncoder(w)}
+}
+
+func (bw *BatchLogWriter) Write(b BatchSize) error {
+	if bw == nil {
+		return nil
+	}
+	b.Record = "batch"
+	bw.lock.Lock()
+	defer bw.lock.Unlock()
+	return bw.enc.Encode(b)
+}
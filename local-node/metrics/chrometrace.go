@@ -0,0 +1,208 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ChromeTraceWriter writes the events of the Monitor and the FindProviderMonitor of every get in the Chrome Trace Event
+Format, to be opened in Perfetto (ui.perfetto.dev) or chrome://tracing. Events are streamed as a JSON array, which both
+accept even if the run is killed before Close.
+
+Every get is one process with one track per block, ordered like its Timeline:
+
+	blockservice: from the blockservice request to the bitswap request
+	bitswap:      from the bitswap request until the block arrived
+	put store:    from arrival until the block was stored
+	visit:        while the DAG reader visited the block
+
+plus instants for every want sent, provider search and provider found. All gets share one "peers" process with one
+track per peer, holding the blocks wanted from and sent by the peer and the DHT queries, requests and responses of the
+provider searches it took part in.
+*/
+type ChromeTraceWriter struct {
+	lock  sync.Mutex
+	w     io.Writer
+	n     int
+	gets  int
+	peers map[string]int
+}
+
+// trace event, timestamps and durations are in microseconds
+type traceEvent struct {
+	Name string                 `json:"name"`
+	Cat  string                 `json:"cat,omitempty"`
+	Ph   string                 `json:"ph"`
+	Ts   float64                `json:"ts"`
+	Dur  float64                `json:"dur,omitempty"`
+	Pid  int                    `json:"pid"`
+	Tid  int                    `json:"tid"`
+	S    string                 `json:"s,omitempty"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+const peersPid = 1
+
+func NewChromeTraceWriter(w io.Writer) *ChromeTraceWriter {
+	return &ChromeTraceWriter{w: w, peers: make(map[string]int)}
+}
+
+func micros(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1000
+}
+
+// Write adds the events of one get, m and fpm are the monitors of that get and may be nil.
+func (tw *ChromeTraceWriter) Write(m *Monitor, fpm *FindProviderMonitor, file string) error {
+	if tw == nil || m == nil {
+		return nil
+	}
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	tw.gets++
+	pid := peersPid + tw.gets
+	var events []traceEvent
+	if tw.gets == 1 {
+		events = append(events, metadata("process_name", peersPid, 0, "peers"))
+	}
+	events = append(events, metadata("process_name", pid, 0, "get "+file))
+	peer := func(p string) int {
+		tid, ok := tw.peers[p]
+		if !ok {
+			tid = len(tw.peers) + 1
+			tw.peers[p] = tid
+			events = append(events, metadata("thread_name", peersPid, tid, p))
+		}
+		return tid
+	}
+	at := func(ms *float64) float64 {
+		return micros(m.GetStartTime) + *ms*1000
+	}
+	span := func(name, cat string, pid, tid int, from, to *float64, args map[string]interface{}) {
+		if from != nil && to != nil && *to >= *from {
+			events = append(events, traceEvent{Name: name, Cat: cat, Ph: "X", Ts: at(from), Dur: (*to - *from) * 1000, Pid: pid, Tid: tid, Args: args})
+		}
+	}
+	instant := func(name, cat string, pid, tid int, ts float64, args map[string]interface{}) {
+		events = append(events, traceEvent{Name: name, Cat: cat, Ph: "i", Ts: ts, Pid: pid, Tid: tid, S: "t", Args: args})
+	}
+
+	for i, b := range m.Timeline(file) {
+		tid := i + 1
+		events = append(events, metadata("thread_name", pid, tid, b.Block))
+		span("blockservice", "block", pid, tid, b.BlockService, b.Request, nil)
+		span("bitswap", "block", pid, tid, b.Request, b.Receive, map[string]interface{}{
+			"from": b.From, "redundant_reqs": b.RedundantReqs, "redundant_blocks": b.RedundantBlocks})
+		span("put store", "block", pid, tid, b.Receive, b.PutStore, nil)
+		span("visit", "block", pid, tid, b.BeginVisit, b.FinishVisit, map[string]interface{}{"level": b.Level})
+		if b.FindProvider != nil {
+			instant("find provider", "dht", pid, tid, at(b.FindProvider), nil)
+		}
+		for _, p := range sortedKeys(b.GotProvider) {
+			ms := b.GotProvider[p]
+			instant("got provider", "dht", pid, tid, at(&ms), map[string]interface{}{"peer": p})
+		}
+		for _, p := range sortedKeys(b.WantTo) {
+			ms := b.WantTo[p]
+			instant("want", "bitswap", pid, tid, at(&ms), map[string]interface{}{"peer": p})
+			if p == b.From && b.Receive != nil {
+				span("block", "bitswap", peersPid, peer(p), &ms, b.Receive, map[string]interface{}{"block": b.Block})
+			} else {
+				instant("want", "bitswap", peersPid, peer(p), at(&ms), map[string]interface{}{"block": b.Block})
+			}
+		}
+	}
+
+	if fpm != nil {
+		fpm.EventList.Range(func(key, value interface{}) bool {
+			pe := value.(*ProviderEvent)
+			target := pe.c.String()
+			pe.FirstRequestTime.Range(func(k, v interface{}) bool {
+				p := k.(string)
+				args := map[string]interface{}{"block": target}
+				if cpl, ok := pe.CPL.Load(p); ok {
+					args["cpl"] = cpl
+				}
+				if from, ok := pe.FirstGotCloserFrom.Load(p); ok {
+					args["learned_from"] = from
+				}
+				request := v.(time.Time)
+				if query, ok := pe.FirstQueryTime.Load(p); ok && !request.Before(query.(time.Time)) {
+					events = append(events, traceEvent{Name: "dht dial", Cat: "dht", Ph: "X", Ts: micros(query.(time.Time)), Dur: micros(request) - micros(query.(time.Time)), Pid: peersPid, Tid: peer(p), Args: args})
+				}
+				if response, ok := pe.FirstResponseTime.Load(p); ok && !response.(time.Time).Before(request) {
+					events = append(events, traceEvent{Name: "dht request", Cat: "dht", Ph: "X", Ts: micros(request), Dur: micros(response.(time.Time)) - micros(request), Pid: peersPid, Tid: peer(p), Args: args})
+				} else {
+					instant("dht request", "dht", peersPid, peer(p), micros(request), args)
+				}
+				return true
+			})
+			pe.FirstOutputProviderTime.Range(func(k, v interface{}) bool {
+				p := k.(string)
+				args := map[string]interface{}{"block": target}
+				if from, ok := pe.FirstGotProviderFrom.Load(p); ok {
+					args["learned_from"] = from
+				}
+				instant("provider found", "dht", peersPid, peer(p), micros(v.(time.Time)), args)
+				return true
+			})
+			return true
+		})
+	}
+
+	for _, e := range events {
+		if err := tw.encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tw *ChromeTraceWriter) encode(e traceEvent) error {
+	sep := ",\n"
+	if tw.n == 0 {
+		sep = "[\n"
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(tw.w, sep); err != nil {
+		return err
+	}
+	_, err = tw.w.Write(data)
+	tw.n++
+	return err
+}
+
+// Close terminates the JSON array, it does not close the underlying writer.
+func (tw *ChromeTraceWriter) Close() error {
+	if tw == nil {
+		return nil
+	}
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if tw.n == 0 {
+		_, err := io.WriteString(tw.w, "[]\n")
+		return err
+	}
+	_, err := io.WriteString(tw.w, "\n]\n")
+	return err
+}
+
+func metadata(name string, pid, tid int, value string) traceEvent {
+	return traceEvent{Name: name, Ph: "M", Pid: pid, Tid: tid, Args: map[string]interface{}{"name": value}}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
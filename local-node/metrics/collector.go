@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/*
+Collector holds the breakdown of one operation: the Monitor and FindProviderMonitor of a get, and the time an add
+spends in the stages below. It travels in the context of the operation, so instrumented code can fill the collector of
+its own operation with MonitorFrom, FPMonitorFrom and Record instead of BDMonitor, FPMonitor and AddDura, ProvideDura,
+... Collect merges it into the timers once the operation is done.
+
+The forked go-bitswap, go-blockservice, go-libp2p-kad-dht and go-ds-flatfs still write to the globals. An operation
+that starts while no other one is in flight points BDMonitor and FPMonitor at its own monitors and clears the global
+durations, so what the forks record until it is done belongs to it. Operations that overlap (-p, -cg, traceDownload,
+findproviderqps) cannot tell their events apart, they are marked Overlapped and Collect only merges what they recorded
+through their context.
+*/
+type Collector struct {
+	Monitor *Monitor
+	FP      *FindProviderMonitor
+
+	lock       sync.Mutex
+	stages     [numStages]time.Duration
+	overlapped bool
+	finished   bool
+}
+
+// Stage is a part of an add whose time is recorded with Record.
+type Stage int
+
+const (
+	StageAdd Stage = iota
+	StageProvide
+	StagePersist
+	StageFlatfsHas
+	StageFlatfsPut
+	numStages
+)
+
+type collectorKey struct{}
+
+// globalLock guards the globals the collectors fall back to, the collectors in flight and the merging into the timers.
+var globalLock sync.Mutex
+
+// inFlight holds the collectors whose operation is not done yet.
+var inFlight = make(map[*Collector]struct{})
+
+// WithCollector returns a context carrying a new Collector for one operation.
+func WithCollector(ctx context.Context) (context.Context, *Collector) {
+	c := &Collector{Monitor: Newmonitor(), FP: NewFPMonitor()}
+	globalLock.Lock()
+	if len(inFlight) == 0 {
+		BDMonitor, FPMonitor = c.Monitor, c.FP
+		for s := StageAdd; s < numStages; s++ {
+			*globalStage(s) = 0
+		}
+	} else {
+		c.overlapped = true
+		for o := range inFlight {
+			o.overlapped = true
+		}
+	}
+	inFlight[c] = struct{}{}
+	globalLock.Unlock()
+	return context.WithValue(ctx, collectorKey{}, c), c
+}
+
+// CollectorFrom returns the collector of the operation ctx belongs to, nil if there is none.
+func CollectorFrom(ctx context.Context) *Collector {
+	if ctx == nil {
+		return nil
+	}
+	c, _ := ctx.Value(collectorKey{}).(*Collector)
+	return c
+}
+
+// MonitorFrom returns the Monitor the events of a get in ctx go to, BDMonitor if the get has no collector.
+func MonitorFrom(ctx context.Context) *Monitor {
+	if c := CollectorFrom(ctx); c != nil {
+		return c.Monitor
+	}
+	return BDMonitor
+}
+
+// FPMonitorFrom returns the FindProviderMonitor the events of a lookup in ctx go to, FPMonitor if there is no collector.
+func FPMonitorFrom(ctx context.Context) *FindProviderMonitor {
+	if c := CollectorFrom(ctx); c != nil {
+		return c.FP
+	}
+	return FPMonitor
+}
+
+// Record adds d to stage s of the operation in ctx, or to the global duration of the stage without a collector.
+func Record(ctx context.Context, s Stage, d time.Duration) {
+	if !CMD_EnableMetrics {
+		return
+	}
+	if c := CollectorFrom(ctx); c != nil {
+		c.lock.Lock()
+		c.stages[s] += d
+		c.lock.Unlock()
+		return
+	}
+	globalLock.Lock()
+	*globalStage(s) += d
+	globalLock.Unlock()
+}
+
+func globalStage(s Stage) *time.Duration {
+	switch s {
+	case StageProvide:
+		return &ProvideDura
+	case StagePersist:
+		return &PersistDura
+	case StageFlatfsHas:
+		return &FlatfsHasDura
+	case StageFlatfsPut:
+		return &FlatfsPutDura
+	}
+	return &AddDura
+}
+
+// Overlapped tells whether another operation was in flight at some point of this one, so that the events the forks
+// recorded into its monitors may belong to either.
+func (c *Collector) Overlapped() bool {
+	globalLock.Lock()
+	defer globalLock.Unlock()
+	return c.overlapped
+}
+
+/*
+Collect merges the breakdown of the operation into the timers: the stages of an add if it recorded one, the Monitor of
+a get if it set GetStartTime, and every provider lookup. An add takes the durations the forks recorded into the globals
+along. The parts the forks fill are left out if the operation overlapped with another one.
+*/
+func (c *Collector) Collect() {
+	c.done(true)
+}
+
+// Discard drops the breakdown of an operation that is not measured, e.g. one of the warmup. An operation that is not in
+// flight any more is left as it is, so a deferred Discard also covers the paths that end the operation early.
+func (c *Collector) Discard() {
+	c.done(false)
+}
+
+func (c *Collector) done(merge bool) {
+	if c == nil {
+		return
+	}
+	globalLock.Lock()
+	defer globalLock.Unlock()
+	if c.finished {
+		return
+	}
+	c.finished = true
+	delete(inFlight, c)
+	if !merge || !CMD_EnableMetrics {
+		return
+	}
+
+	c.lock.Lock()
+	stages := c.stages
+	c.stages = [numStages]time.Duration{}
+	c.lock.Unlock()
+	if stages[StageAdd] > 0 {
+		AddTimer.Update(stages[StageAdd])
+		if !c.overlapped {
+			for s := StageProvide; s < numStages; s++ {
+				stages[s] += *globalStage(s)
+			}
+			Provide.Update(stages[StageProvide])
+			Persist.Update(stages[StagePersist])
+			Dag.Update(stages[StageAdd] - stages[StageProvide] - stages[StagePersist])
+			FlatfsHasTimer.Update(stages[StageFlatfsHas])
+			FlatfsPut.Update(stages[StageFlatfsPut])
+		}
+	}
+	if c.overlapped {
+		return
+	}
+	if !c.Monitor.GetStartTime.IsZero() {
+		c.Monitor.collect()
+	}
+	c.FP.collect()
+}
@@ -5,7 +5,9 @@ go 1.16
 require (
 	github.com/hashicorp/golang-lru v0.5.4
 	github.com/ipfs/go-cid v0.0.7
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.18.0
 	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475
-	github.com/whyrusleeping/go-keyspace v0.0.0-20160322163242-5b898ac5add1
 	github.com/syndtr/goleveldb v1.0.0
+	github.com/whyrusleeping/go-keyspace v0.0.0-20160322163242-5b898ac5add1
 )
@@ -0,0 +1,289 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// hdrSubBucketBits sets the precision of a LatencyHistogram: values are kept with 2^11 = 2048 linear sub-buckets per
+// power of two, i.e. 3 significant decimal digits (relative error below 0.1%).
+const hdrSubBucketBits = 11
+
+const (
+	hdrSubBuckets     = 1 << hdrSubBucketBits
+	hdrHalfSubBuckets = hdrSubBuckets / 2
+)
+
+/*
+LatencyHistogram is a high dynamic range (HDR) histogram of durations in nanoseconds. Unlike the sampled go-metrics
+timers it counts every value, so percentiles are exact up to its precision no matter how many values were recorded,
+and two histograms can be merged without losing anything: the histograms of several workers, or of several nodes
+read back from their result files, add up to the histogram of the whole run.
+
+It has the reading methods of a go-metrics Timer (Count, Mean, Max, Percentile, ...) so it can stand in for one.
+Percentile takes a quantile in [0, 1].
+*/
+type LatencyHistogram struct {
+	lock   sync.Mutex
+	counts []int64
+	count  int64
+	sum    float64
+	min    int64
+	max    int64
+}
+
+func NewLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{min: math.MaxInt64}
+}
+
+// latencyRegistry holds the registered LatencyHistograms, the go-metrics registry silently drops types it does not know.
+var latencyRegistry = struct {
+	sync.Mutex
+	histograms map[string]*LatencyHistogram
+}{histograms: make(map[string]*LatencyHistogram)}
+
+func registerLatency(name string, h *LatencyHistogram) {
+	latencyRegistry.Lock()
+	defer latencyRegistry.Unlock()
+	latencyRegistry.histograms[name] = h
+}
+
+// eachLatency calls f for every registered LatencyHistogram.
+func eachLatency(f func(name string, h *LatencyHistogram)) {
+	latencyRegistry.Lock()
+	defer latencyRegistry.Unlock()
+	for name, h := range latencyRegistry.histograms {
+		f(name, h)
+	}
+}
+
+// hdrIndex maps a value to its bucket: the first hdrSubBuckets values are exact, above that each power of two is
+// split into hdrHalfSubBuckets linear sub-buckets.
+func hdrIndex(v int64) int {
+	shift := bits.Len64(uint64(v)) - hdrSubBucketBits
+	if shift <= 0 {
+		return int(v)
+	}
+	return hdrSubBuckets + (shift-1)*hdrHalfSubBuckets + int(v>>uint(shift)) - hdrHalfSubBuckets
+}
+
+// hdrValue returns the highest value that maps to bucket i, so percentiles never under-report.
+func hdrValue(i int) int64 {
+	if i < hdrSubBuckets {
+		return int64(i)
+	}
+	shift := (i-hdrSubBuckets)/hdrHalfSubBuckets + 1
+	sub := int64((i-hdrSubBuckets)%hdrHalfSubBuckets + hdrHalfSubBuckets)
+	return (sub+1)<<uint(shift) - 1
+}
+
+// Record adds one value, negative values count as 0.
+func (h *LatencyHistogram) Record(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	i := hdrIndex(v)
+	if i >= len(h.counts) {
+		counts := make([]int64, i+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += float64(v)
+	if v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+}
+
+// Update records a duration, like metrics.Timer.Update.
+func (h *LatencyHistogram) Update(d time.Duration) {
+	h.Record(int64(d))
+}
+
+// UpdateSince records the time elapsed since t, like metrics.Timer.UpdateSince.
+func (h *LatencyHistogram) UpdateSince(t time.Time) {
+	h.Record(int64(time.Since(t)))
+}
+
+// Merge adds all values of o to h.
+func (h *LatencyHistogram) Merge(o *LatencyHistogram) {
+	if o == nil || o == h {
+		return
+	}
+	o.lock.Lock()
+	counts := append([]int64(nil), o.counts...)
+	count, sum, min, max := o.count, o.sum, o.min, o.max
+	o.lock.Unlock()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(counts) > len(h.counts) {
+		grown := make([]int64, len(counts))
+		copy(grown, h.counts)
+		h.counts = grown
+	}
+	for i, c := range counts {
+		h.counts[i] += c
+	}
+	h.count += count
+	h.sum += sum
+	if count > 0 && min < h.min {
+		h.min = min
+	}
+	if max > h.max {
+		h.max = max
+	}
+}
+
+func (h *LatencyHistogram) Count() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.count
+}
+
+func (h *LatencyHistogram) Sum() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return int64(h.sum)
+}
+
+func (h *LatencyHistogram) Mean() float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / float64(h.count)
+}
+
+func (h *LatencyHistogram) Min() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	return h.min
+}
+
+func (h *LatencyHistogram) Max() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.max
+}
+
+// Percentile returns the value below which a fraction q (0.99 for p99) of all values fall.
+func (h *LatencyHistogram) Percentile(q float64) float64 {
+	return h.Percentiles([]float64{q})[0]
+}
+
+// Percentiles returns Percentile for each of qs.
+func (h *LatencyHistogram) Percentiles(qs []float64) []float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	ps := make([]float64, len(qs))
+	if h.count == 0 {
+		return ps
+	}
+	for j, q := range qs {
+		if q < 0 {
+			q = 0
+		}
+		if q > 1 {
+			q = 1
+		}
+		rank := int64(math.Ceil(q * float64(h.count)))
+		if rank < 1 {
+			rank = 1
+		}
+		var seen int64
+		for i, c := range h.counts {
+			seen += c
+			if seen >= rank {
+				v := hdrValue(i)
+				// the bucket bound may lie outside of what was actually recorded
+				if v > h.max {
+					v = h.max
+				}
+				if v < h.min {
+					v = h.min
+				}
+				ps[j] = float64(v)
+				break
+			}
+		}
+	}
+	return ps
+}
+
+// String summarizes the histogram in milliseconds.
+func (h *LatencyHistogram) String() string {
+	ps := h.Percentiles([]float64{0.5, 0.9, 0.99, 0.999})
+	return fmt.Sprintf("count %d avg %f ms p50 %f ms p90 %f ms p99 %f ms p99.9 %f ms max %f ms",
+		h.Count(), h.Mean()/MS, ps[0]/MS, ps[1]/MS, ps[2]/MS, ps[3]/MS, float64(h.Max())/MS)
+}
+
+// latencyHistogramJSON is the portable form of a histogram: only non-empty buckets, as [index, count] pairs.
+type latencyHistogramJSON struct {
+	SubBucketBits int        `json:"sub_bucket_bits"`
+	Count         int64      `json:"count"`
+	Sum           float64    `json:"sum"`
+	Min           int64      `json:"min"`
+	Max           int64      `json:"max"`
+	Buckets       [][2]int64 `json:"buckets"`
+}
+
+// MarshalJSON encodes the histogram so that result files of different nodes can be merged afterwards.
+func (h *LatencyHistogram) MarshalJSON() ([]byte, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	enc := latencyHistogramJSON{SubBucketBits: hdrSubBucketBits, Count: h.count, Sum: h.sum, Min: h.min, Max: h.max, Buckets: [][2]int64{}}
+	if h.count == 0 {
+		enc.Min = 0
+	}
+	for i, c := range h.counts {
+		if c != 0 {
+			enc.Buckets = append(enc.Buckets, [2]int64{int64(i), c})
+		}
+	}
+	return json.Marshal(enc)
+}
+
+func (h *LatencyHistogram) UnmarshalJSON(data []byte) error {
+	var enc latencyHistogramJSON
+	if err := json.Unmarshal(data, &enc); err != nil {
+		return err
+	}
+	if enc.SubBucketBits != hdrSubBucketBits {
+		return fmt.Errorf("histogram precision %d does not match %d", enc.SubBucketBits, hdrSubBucketBits)
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.counts = nil
+	for _, b := range enc.Buckets {
+		i := int(b[0])
+		if i < 0 || i > hdrIndex(math.MaxInt64) {
+			return fmt.Errorf("histogram bucket %d out of range", i)
+		}
+		if i >= len(h.counts) {
+			counts := make([]int64, i+1)
+			copy(counts, h.counts)
+			h.counts = counts
+		}
+		h.counts[i] += b[1]
+	}
+	h.count, h.sum, h.min, h.max = enc.Count, enc.Sum, enc.Min, enc.Max
+	if h.count == 0 {
+		h.min = math.MaxInt64
+	}
+	return nil
+}
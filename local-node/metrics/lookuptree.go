@@ -0,0 +1,267 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+LookupTree is the DHT search of one provider lookup as recorded by a ProviderEvent: every peer the lookup learned of,
+with an edge from the peer it was learned from (FirstGotCloserFrom, FirstGotProviderFrom), or from the searching node
+itself for the seed peers taken from the local routing table. Times are milliseconds since FindProvidersAsync.
+
+The critical path is the chain of peers that led to the provider found first, from the provider back to a seed peer,
+the path CollectFPMonitor models the lookup latency with.
+*/
+type LookupTree struct {
+	Record        string       `json:"record"`
+	File          string       `json:"file,omitempty"`
+	Block         string       `json:"block"`
+	Self          string       `json:"self"`
+	Start         time.Time    `json:"start"`
+	LocalSearchMs *float64     `json:"local_search_ms,omitempty"`
+	Nodes         []LookupNode `json:"nodes"`
+	CriticalPath  []string     `json:"critical_path"`
+}
+
+type LookupNode struct {
+	Peer        string   `json:"peer"`
+	CPL         *int     `json:"cpl,omitempty"`
+	LearnedFrom string   `json:"learned_from,omitempty"`
+	Seed        bool     `json:"seed,omitempty"`
+	Provider    bool     `json:"provider,omitempty"`
+	Critical    bool     `json:"critical,omitempty"`
+	QueryMs     *float64 `json:"query_ms,omitempty"`
+	RequestMs   *float64 `json:"request_ms,omitempty"`
+	ResponseMs  *float64 `json:"response_ms,omitempty"`
+	ProviderMs  *float64 `json:"provider_ms,omitempty"`
+}
+
+// LookupTrees returns the lookup tree of every provider lookup of the monitored get, in the order they started.
+func (m *FindProviderMonitor) LookupTrees(file string) []LookupTree {
+	if !CMD_EnableMetrics || m == nil {
+		return nil
+	}
+	var trees []LookupTree
+	m.EventList.Range(func(key, value interface{}) bool {
+		trees = append(trees, value.(*ProviderEvent).lookupTree(file))
+		return true
+	})
+	sort.Slice(trees, func(i, j int) bool {
+		return trees[i].Start.Before(trees[j].Start)
+	})
+	return trees
+}
+
+func (pe *ProviderEvent) lookupTree(file string) LookupTree {
+	since := func(v interface{}, ok bool) *float64 {
+		if !ok {
+			return nil
+		}
+		ms := v.(time.Time).Sub(pe.FindProviderAsync).Seconds() * 1000
+		return &ms
+	}
+	nodes := make(map[string]*LookupNode)
+	node := func(p string) *LookupNode {
+		if n, ok := nodes[p]; ok {
+			return n
+		}
+		n := &LookupNode{Peer: p}
+		if cpl, ok := pe.CPL.Load(p); ok {
+			c := cpl.(int)
+			n.CPL = &c
+		}
+		n.QueryMs = since(pe.FirstQueryTime.Load(p))
+		n.RequestMs = since(pe.FirstRequestTime.Load(p))
+		n.ResponseMs = since(pe.FirstResponseTime.Load(p))
+		nodes[p] = n
+		return n
+	}
+
+	for _, p := range pe.SeedPeers {
+		node(p).Seed = true
+	}
+	pe.FirstGotCloserFrom.Range(func(k, v interface{}) bool {
+		node(k.(string)).LearnedFrom = v.(string)
+		node(v.(string))
+		return true
+	})
+	for _, times := range []*sync.Map{&pe.FirstQueryTime, &pe.FirstRequestTime, &pe.FirstResponseTime} {
+		times.Range(func(k, v interface{}) bool {
+			node(k.(string))
+			return true
+		})
+	}
+	first, firstAt := "", time.Time{}
+	pe.FirstGotProviderFrom.Range(func(k, v interface{}) bool {
+		n := node(k.(string))
+		n.Provider = true
+		// a provider that was also a closer peer of another response keeps the edge that led to it as provider
+		n.LearnedFrom = v.(string)
+		node(v.(string))
+		if t, ok := pe.FirstOutputProviderTime.Load(k); ok {
+			n.ProviderMs = since(t, true)
+			if first == "" || t.(time.Time).Before(firstAt) {
+				first, firstAt = k.(string), t.(time.Time)
+			}
+		}
+		return true
+	})
+
+	// walk back from the first provider, the learned-from edges of the DHT can form cycles
+	var critical []string
+	for p := first; p != "" && nodes[p] != nil && !nodes[p].Critical; {
+		nodes[p].Critical = true
+		critical = append(critical, p)
+		if nodes[p].Seed {
+			break
+		}
+		p = nodes[p].LearnedFrom
+	}
+	delete(nodes, pe.self)
+
+	tree := LookupTree{
+		Record:       "lookup",
+		File:         file,
+		Block:        pe.c.String(),
+		Self:         pe.self,
+		Start:        pe.FindProviderAsync,
+		CriticalPath: critical,
+	}
+	if pe.FinishLocalSearch != ZeroTime {
+		tree.LocalSearchMs = since(pe.FinishLocalSearch, true)
+	}
+	for _, n := range nodes {
+		tree.Nodes = append(tree.Nodes, *n)
+	}
+	sort.Slice(tree.Nodes, func(i, j int) bool {
+		a, b := tree.Nodes[i], tree.Nodes[j]
+		if (a.QueryMs == nil) != (b.QueryMs == nil) {
+			return a.QueryMs != nil
+		}
+		if a.QueryMs != nil && *a.QueryMs != *b.QueryMs {
+			return *a.QueryMs < *b.QueryMs
+		}
+		return a.Peer < b.Peer
+	})
+	return tree
+}
+
+/*
+DOT renders the tree for Graphviz, e.g. dot -Tsvg. Seed peers are boxes hanging off the searching node, providers are
+double octagons, and peers that were learned of but never queried are dashed. The critical path is drawn in red. Every
+peer is labelled with the end of its ID, its CPL and the times it was queried and answered.
+*/
+func (t *LookupTree) DOT() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %q {\n", t.Block)
+	fmt.Fprintf(&b, "\tlabel=%q;\n\trankdir=LR;\n\tnode [fontsize=10];\n", "lookup of "+t.Block)
+	fmt.Fprintf(&b, "\t%q [label=\"self\\n%s\", shape=circle, style=filled, fillcolor=lightgray];\n", t.Self, shortPeer(t.Self))
+	critical := make(map[string]bool)
+	for _, p := range t.CriticalPath {
+		critical[p] = true
+	}
+	for _, n := range t.Nodes {
+		label := shortPeer(n.Peer)
+		if n.CPL != nil {
+			label += fmt.Sprintf("\\ncpl %d", *n.CPL)
+		}
+		if n.QueryMs != nil {
+			label += fmt.Sprintf("\\nquery %.1f ms", *n.QueryMs)
+		}
+		if n.ResponseMs != nil {
+			label += fmt.Sprintf("\\nresponse %.1f ms", *n.ResponseMs)
+		}
+		if n.ProviderMs != nil {
+			label += fmt.Sprintf("\\nprovider %.1f ms", *n.ProviderMs)
+		}
+		attrs := []string{fmt.Sprintf("label=\"%s\"", label)}
+		switch {
+		case n.Provider:
+			attrs = append(attrs, "shape=doubleoctagon", "style=filled", "fillcolor=palegreen")
+		case n.Seed:
+			attrs = append(attrs, "shape=box", "style=filled", "fillcolor=lightblue")
+		case n.QueryMs == nil && n.RequestMs == nil:
+			attrs = append(attrs, "style=dashed")
+		}
+		if n.Critical {
+			attrs = append(attrs, "color=red", "penwidth=2")
+		}
+		fmt.Fprintf(&b, "\t%q [%s];\n", n.Peer, strings.Join(attrs, ", "))
+
+		from := n.LearnedFrom
+		if from == "" {
+			if !n.Seed {
+				continue
+			}
+			from = t.Self
+		}
+		edge := ""
+		if n.Critical && (critical[from] || from == t.Self) {
+			edge = " [color=red, penwidth=2]"
+		}
+		fmt.Fprintf(&b, "\t%q -> %q%s;\n", from, n.Peer, edge)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func shortPeer(p string) string {
+	if len(p) > 8 {
+		return ".." + p[len(p)-6:]
+	}
+	return p
+}
+
+// LookupTreeWriter writes the lookup trees of every get to lookup.jsonl in its directory, and each of them to
+// <block>.dot, a later lookup of a block overwrites the DOT file of the earlier one.
+type LookupTreeWriter struct {
+	lock sync.Mutex
+	dir  string
+	file *os.File
+	enc  *json.Encoder
+}
+
+func NewLookupTreeWriter(dir string) (*LookupTreeWriter, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(dir, "lookup.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	return &LookupTreeWriter{dir: dir, file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Write writes the lookup trees of one get, m is the FindProviderMonitor of that get.
+func (lw *LookupTreeWriter) Write(m *FindProviderMonitor, file string) error {
+	if lw == nil {
+		return nil
+	}
+	trees := m.LookupTrees(file)
+	lw.lock.Lock()
+	defer lw.lock.Unlock()
+	for i := range trees {
+		if err := lw.enc.Encode(trees[i]); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(lw.dir, trees[i].Block+".dot"), []byte(trees[i].DOT()), 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (lw *LookupTreeWriter) Close() error {
+	if lw == nil {
+		return nil
+	}
+	return lw.file.Close()
+}
@@ -30,12 +30,16 @@ var CMD_PeerRH = false
 var CMD_NoneNeighbourAsking = false
 var CMD_DisCoWorer = false
 var CMD_PBitswap_Ticker = false
+var CMD_PBitswapBalance = false
+var CMD_PBitswapEndgame = 0
 
 // var CMD_LoadSaveCache = false
 var EnablePbitswap = false
 
 var BlockSizeLimit = 1 * 1024 * 1024
 
+// TimerPin, SyncTime and DeduplicateOverhead stay go-metrics Timers, the forked go-ipfs modules update them through
+// that interface. All other timers are LatencyHistograms.
 var TimerPin []metrics.Timer
 var pinNumber = 2
 var TimePin time.Time
@@ -43,19 +47,19 @@ var Times []time.Duration
 
 // ADD Metrics
 
-var AddTimer metrics.Timer
-var Provide metrics.Timer
-var Persist metrics.Timer
-var Dag metrics.Timer
+var AddTimer *LatencyHistogram
+var Provide *LatencyHistogram
+var Persist *LatencyHistogram
+var Dag *LatencyHistogram
 
 var PersistDura time.Duration
 var ProvideDura time.Duration
 var AddDura time.Duration
 
-var FlatfsHasTimer metrics.Timer
+var FlatfsHasTimer *LatencyHistogram
 var FlatfsHasDura time.Duration
 
-var FlatfsPut metrics.Timer
+var FlatfsPut *LatencyHistogram
 var FlatfsPutDura time.Duration
 
 var SyncTime metrics.Timer
@@ -72,34 +76,34 @@ var DeduplicateOverhead metrics.Timer
 // Get Metrics
 
 var BDMonitor *Monitor
-var BlockServiceTime metrics.Timer
-var RootNeighbourAskingTime metrics.Timer
-var RootFindProviderTime metrics.Timer
-var RootWaitToWantTime metrics.Timer
-var LeafWaitToWantTime metrics.Timer
-var BitswapTime metrics.Timer
-var PutStoreTime metrics.Timer
-var VisitTime metrics.Timer
-
-var RealGet metrics.Timer
-var ModelGet metrics.Timer
+var BlockServiceTime *LatencyHistogram
+var RootNeighbourAskingTime *LatencyHistogram
+var RootFindProviderTime *LatencyHistogram
+var RootWaitToWantTime *LatencyHistogram
+var LeafWaitToWantTime *LatencyHistogram
+var BitswapTime *LatencyHistogram
+var PutStoreTime *LatencyHistogram
+var VisitTime *LatencyHistogram
+
+var RealGet *LatencyHistogram
+var ModelGet *LatencyHistogram
 var Sample metrics.Sample
 var Variance metrics.Histogram
 
-var GetNode metrics.Timer
-var WriteTo metrics.Timer
+var GetNode *LatencyHistogram
+var WriteTo *LatencyHistogram
 
 var BlocksRedundant metrics.Histogram
 var RequestsRedundant metrics.Histogram
 
 // findProvider metrics
 var FPMonitor *FindProviderMonitor
-var ChoosePeer metrics.Timer
-var DailPeer metrics.Timer
-var ResponsePeer metrics.Timer
+var ChoosePeer *LatencyHistogram
+var DailPeer *LatencyHistogram
+var ResponsePeer *LatencyHistogram
 
-var RealFindProvider metrics.Timer
-var ModelFindProvider metrics.Timer
+var RealFindProvider *LatencyHistogram
+var ModelFindProvider *LatencyHistogram
 var Samplefp metrics.Sample
 var FPVariance metrics.Histogram
 var Samplefpn metrics.Sample
@@ -108,9 +112,13 @@ var FPInner metrics.Histogram
 // trace-download period throughput output
 
 var DownloadedFileSize []int
-var AvgDownloadLatency metrics.Timer
+var AvgDownloadLatency *LatencyHistogram
 var ALL_DownloadedFileSize []int
-var ALL_AvgDownloadLatency metrics.Timer
+var ALL_AvgDownloadLatency *LatencyHistogram
+
+// DownloadedLock guards DownloadedFileSize, ALL_DownloadedFileSize and the swapping of AvgDownloadLatency, the
+// concurrent gets of traceDownload update them while the period log reads and resets them
+var DownloadedLock sync.Mutex
 
 var GetBreakDownLog = false
 var CPLInDHTQureyLog = false
@@ -123,10 +131,10 @@ var DataStorePut metrics.Histogram
 var MetricsStartTime time.Time
 
 func TraceDownMetricsInit() {
-	AvgDownloadLatency = metrics.NewTimer()
-	metrics.Register("AvgDownloadLatency", AvgDownloadLatency)
-	ALL_AvgDownloadLatency = metrics.NewTimer()
-	metrics.Register("ALL_AvgDownloadLatency", ALL_AvgDownloadLatency)
+	AvgDownloadLatency = NewLatencyHistogram()
+	register("AvgDownloadLatency", AvgDownloadLatency)
+	ALL_AvgDownloadLatency = NewLatencyHistogram()
+	register("ALL_AvgDownloadLatency", ALL_AvgDownloadLatency)
 
 	go func() {
 		timeUnit := time.Minute
@@ -139,6 +147,7 @@ func TraceDownMetricsInit() {
 			file.Close()
 		}()
 		for {
+			DownloadedLock.Lock()
 			totalsize := 0
 			for _, s := range DownloadedFileSize {
 				totalsize += s
@@ -147,15 +156,16 @@ func TraceDownMetricsInit() {
 
 			//time throughput(MB/s) count averageLatency(ms) 99-percentile Latency
 			line := fmt.Sprintf("%s %f %d %f %f\n", time.Now().String(), throughput, AvgDownloadLatency.Count(), AvgDownloadLatency.Mean()/MS, AvgDownloadLatency.Percentile(0.99)/MS)
+			DownloadedFileSize = []int{}
+			AvgDownloadLatency = NewLatencyHistogram()
+			register("AvgDownloadLatency", AvgDownloadLatency)
+			DownloadedLock.Unlock()
 			_, err := write.WriteString(line)
 			if err != nil {
 				fmt.Printf("failed to write string to log file, %s\n", err.Error())
 			}
 			write.Flush()
 
-			DownloadedFileSize = []int{}
-			AvgDownloadLatency = metrics.NewTimer()
-			metrics.Register("AvgDownloadLatency", AvgDownloadLatency)
 			time.Sleep(timeUnit)
 		}
 
@@ -169,95 +179,95 @@ func TimersInit() {
 	MetricsStartTime = time.Now()
 	for i := 0; i < pinNumber; i++ {
 		pin := metrics.NewTimer()
-		metrics.Register("pin"+string(rune(i)), pin)
+		register("pin"+string(rune(i)), pin)
 		TimerPin = append(TimerPin, pin)
 	}
 
-	AddTimer = metrics.NewTimer()
-	metrics.Register("Add", AddTimer)
+	AddTimer = NewLatencyHistogram()
+	register("Add", AddTimer)
 
-	Provide = metrics.NewTimer()
-	metrics.Register("Provide", Provide)
+	Provide = NewLatencyHistogram()
+	register("Provide", Provide)
 
-	Persist = metrics.NewTimer()
-	metrics.Register("Persist-Flush", Persist)
+	Persist = NewLatencyHistogram()
+	register("Persist-Flush", Persist)
 
-	Dag = metrics.NewTimer()
-	metrics.Register("dag", Dag)
+	Dag = NewLatencyHistogram()
+	register("dag", Dag)
 
-	FlatfsHasTimer = metrics.NewTimer()
-	metrics.Register("flafshas", FlatfsHasTimer)
+	FlatfsHasTimer = NewLatencyHistogram()
+	register("flafshas", FlatfsHasTimer)
 
-	FlatfsPut = metrics.NewTimer()
-	metrics.Register("flatfsPut", FlatfsPut)
+	FlatfsPut = NewLatencyHistogram()
+	register("flatfsPut", FlatfsPut)
 
 	SyncTime = metrics.NewTimer()
-	metrics.Register("SyncTime", SyncTime)
+	register("SyncTime", SyncTime)
 	DeduplicateOverhead = metrics.NewTimer()
-	metrics.Register("DeduplicateOverhead", DeduplicateOverhead)
+	register("DeduplicateOverhead", DeduplicateOverhead)
 
 	BDMonitor = Newmonitor()
-	BlockServiceTime = metrics.NewTimer()
-	metrics.Register("BlockServiceTime", BlockServiceTime)
-	RootNeighbourAskingTime = metrics.NewTimer()
-	metrics.Register("RootNeighbourAskingTime", RootNeighbourAskingTime)
-	RootFindProviderTime = metrics.NewTimer()
-	metrics.Register("RootFindProviderTime", RootFindProviderTime)
-	RootWaitToWantTime = metrics.NewTimer()
-	metrics.Register("RootWaitToWantTime", RootWaitToWantTime)
-	LeafWaitToWantTime = metrics.NewTimer()
-	metrics.Register("LeafWaitToWantTime", LeafWaitToWantTime)
-	BitswapTime = metrics.NewTimer()
-	metrics.Register("BitswapTime", BitswapTime)
-	PutStoreTime = metrics.NewTimer()
-	metrics.Register("PutStoreTime", PutStoreTime)
-	VisitTime = metrics.NewTimer()
-	metrics.Register("VisitTime", VisitTime)
-
-	RealGet = metrics.NewTimer()
-	metrics.Register("RealGet", RealGet)
-	ModelGet = metrics.NewTimer()
-	metrics.Register("ModelGet", ModelGet)
+	BlockServiceTime = NewLatencyHistogram()
+	register("BlockServiceTime", BlockServiceTime)
+	RootNeighbourAskingTime = NewLatencyHistogram()
+	register("RootNeighbourAskingTime", RootNeighbourAskingTime)
+	RootFindProviderTime = NewLatencyHistogram()
+	register("RootFindProviderTime", RootFindProviderTime)
+	RootWaitToWantTime = NewLatencyHistogram()
+	register("RootWaitToWantTime", RootWaitToWantTime)
+	LeafWaitToWantTime = NewLatencyHistogram()
+	register("LeafWaitToWantTime", LeafWaitToWantTime)
+	BitswapTime = NewLatencyHistogram()
+	register("BitswapTime", BitswapTime)
+	PutStoreTime = NewLatencyHistogram()
+	register("PutStoreTime", PutStoreTime)
+	VisitTime = NewLatencyHistogram()
+	register("VisitTime", VisitTime)
+
+	RealGet = NewLatencyHistogram()
+	register("RealGet", RealGet)
+	ModelGet = NewLatencyHistogram()
+	register("ModelGet", ModelGet)
 
 	Sample = metrics.NewUniformSample(102400)
 	Variance = metrics.NewHistogram(Sample)
-	metrics.Register("Variance", Variance)
+	register("Variance", Variance)
 
-	GetNode = metrics.NewTimer()
-	metrics.Register("GetNode", GetNode)
-	WriteTo = metrics.NewTimer()
-	metrics.Register("WriteTo", WriteTo)
+	GetNode = NewLatencyHistogram()
+	register("GetNode", GetNode)
+	WriteTo = NewLatencyHistogram()
+	register("WriteTo", WriteTo)
 
 	BlocksRedundant = metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
-	metrics.Register("BlocksRedundant", BlocksRedundant)
+	register("BlocksRedundant", BlocksRedundant)
 	RequestsRedundant = metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
-	metrics.Register("RequestsRedundant", RequestsRedundant)
+	register("RequestsRedundant", RequestsRedundant)
 
-	ChoosePeer = metrics.NewTimer()
-	metrics.Register("ChoosePeer", ChoosePeer)
-	DailPeer = metrics.NewTimer()
-	metrics.Register("DailPeer", DailPeer)
-	ResponsePeer = metrics.NewTimer()
-	metrics.Register("ResponsePeer", ResponsePeer)
+	ChoosePeer = NewLatencyHistogram()
+	register("ChoosePeer", ChoosePeer)
+	DailPeer = NewLatencyHistogram()
+	register("DailPeer", DailPeer)
+	ResponsePeer = NewLatencyHistogram()
+	register("ResponsePeer", ResponsePeer)
 
-	RealFindProvider = metrics.NewTimer()
-	metrics.Register("RealFindProvider", RealFindProvider)
-	ModelFindProvider = metrics.NewTimer()
-	metrics.Register("ModelFindProvider", ModelFindProvider)
+	RealFindProvider = NewLatencyHistogram()
+	register("RealFindProvider", RealFindProvider)
+	ModelFindProvider = NewLatencyHistogram()
+	register("ModelFindProvider", ModelFindProvider)
 
 	Samplefp = metrics.NewUniformSample(102400)
 	FPVariance = metrics.NewHistogram(Samplefp)
-	metrics.Register("FPVariance", FPVariance)
+	register("FPVariance", FPVariance)
 
 	Samplefpn = metrics.NewUniformSample(102400)
 	FPInner = metrics.NewHistogram(Samplefpn)
-	metrics.Register("FPInner", FPInner)
+	register("FPInner", FPInner)
 
 	FPMonitor = NewFPMonitor()
 	//go metrics.Log(metrics.DefaultRegistry, 1 * time.Second,log.New(os.Stdout, "metrics: ", log.Lmicroseconds))
 
-	ProvideTime = metrics.NewTimer()
-	metrics.Register("Provide", ProvideTime)
+	ProvideTime = NewLatencyHistogram()
+	register("ProvideLatency", ProvideTime)
 	SuccessfullyProvide = 0
 	StartBackProvideTime = ZeroTime
 
@@ -267,14 +277,33 @@ func TimersInit() {
 
 const MS = 1000000
 
+// register puts m into the default registry, replacing any metric registered earlier under the same name, so that
+// re-initialized timers are the ones exported.
+func register(name string, m interface{}) {
+	if h, ok := m.(*LatencyHistogram); ok {
+		registerLatency(name, h)
+		return
+	}
+	metrics.Unregister(name)
+	metrics.Register(name, m)
+}
+
+// CollectMonitor merges BDMonitor into the timers and starts a new one, gets with a Collector use Collector.Collect.
 func CollectMonitor() {
 	if !CMD_EnableMetrics {
 		return
 	}
-	//BDMonitor.TimeStamps()
+	globalLock.Lock()
+	defer globalLock.Unlock()
+	BDMonitor.collect()
+	BDMonitor = Newmonitor()
+}
+
+func (m *Monitor) collect() {
+	//m.TimeStamps()
 
-	//fmt.Printf("total fetch %d\n", BDMonitor.TotalFetches)
-	bd := BDMonitor.GetBreakdown()
+	//fmt.Printf("total fetch %d\n", m.TotalFetches)
+	bd := m.GetBreakdown()
 	for _, t := range bd.BlockService {
 		BlockServiceTime.Update(t)
 	}
@@ -294,23 +323,29 @@ func CollectMonitor() {
 		VisitTime.Update(t)
 	}
 
-	realtime := BDMonitor.RealTime()
-	modeltime := BDMonitor.ModeledTime()
+	realtime := m.RealTime()
+	modeltime := m.ModeledTime()
 	v := int64(((realtime.Seconds() - modeltime.Seconds()) / realtime.Seconds()) * 1000000000) //Histogram requires int data
 	RealGet.Update(realtime)
 	ModelGet.Update(modeltime)
 	Variance.Update(v)
 
-	RequestsRedundant.Update(int64(BDMonitor.SumReqsRedundant()))
-	BlocksRedundant.Update(int64(BDMonitor.SumBlksRedundant()))
-
-	BDMonitor = Newmonitor()
+	RequestsRedundant.Update(int64(m.SumReqsRedundant()))
+	BlocksRedundant.Update(int64(m.SumBlksRedundant()))
 }
 
+// CollectFPMonitor merges the lookups of m into the timers and starts a new FPMonitor.
 func (m *FindProviderMonitor) CollectFPMonitor() {
 	if !CMD_EnableMetrics {
 		return
 	}
+	globalLock.Lock()
+	defer globalLock.Unlock()
+	m.collect()
+	FPMonitor = NewFPMonitor()
+}
+
+func (m *FindProviderMonitor) collect() {
 	m.EventList.Range(func(key, value interface{}) bool {
 		target := key.(string)
 		pe := value.(*ProviderEvent)
@@ -391,9 +426,6 @@ func (m *FindProviderMonitor) CollectFPMonitor() {
 
 		return true
 	})
-
-	newFPM := NewFPMonitor()
-	FPMonitor = newFPM
 }
 func OutputMetrics0() {
 	if !CMD_EnableMetrics {
@@ -413,7 +445,7 @@ func Output_addBreakdown() {
 		return
 	}
 	fmt.Println("-------------------------ADD-------------------------")
-	fmt.Printf("		avg(ms)    0.9p(ms)\n")
+	fmt.Printf("		avg(ms)    0.999p(ms)\n")
 	fmt.Printf("AddTimer: %d %f %f\n", AddTimer.Count(), AddTimer.Mean()/MS, AddTimer.Percentile(0.999)/MS)
 	fmt.Printf("Provide: %d %f %f\n", Provide.Count(), Provide.Mean()/MS, Provide.Percentile(0.999)/MS)
 	fmt.Printf("Persist: %d %f %f\n", Persist.Count(), Persist.Mean()/MS, Persist.Percentile(0.999)/MS)
@@ -547,10 +579,9 @@ func StartBackReport() {
 	}()
 }
 
-func StandardOutput(function string, t metrics.Timer, filesize int) string {
+func StandardOutput(function string, t *LatencyHistogram, filesize int) string {
 	throughput := float64(filesize) / 1024 / 1024 / (t.Mean() / 1000000000)
 	return fmt.Sprintf("%f %f %f\n", throughput, t.Mean()/1000000, t.Percentile(0.99)/MS)
-	// return fmt.Sprintf("%s: %d files, average latency: %f ms, 0.99P latency: %f ms\n", function, t.Count(), t.Mean()/MS, t.Percentile(float64(t.Count())*0.99)/MS)
 }
 
 func StramLevelDBStats(stat leveldb.DBStats) {
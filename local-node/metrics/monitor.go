@@ -23,7 +23,7 @@ import (
 	VisitTime = TotalBlocks * AvgVisit
 */
 type Monitor struct {
-	EventList     sync.Map
+	EventList     sync.Map // cid.Cid -> *BlockEvent, which holds sync.Maps and must not be copied
 	Root          cid.Cid
 	GetStartTime  time.Time
 	GetFinishTime time.Time
@@ -80,7 +80,7 @@ func (m *Monitor) NewBlockEvent(c cid.Cid, l int) {
 	be.lock = new(sync.RWMutex)
 	be.NumOfRedundantReqs = 0
 	be.NumOfRedundantBlks = 0
-	m.EventList.Store(c, be)
+	m.EventList.Store(c, &be)
 	m.TotalBlocks++
 	m.TotalFetches++
 }
@@ -102,7 +102,7 @@ func (m *Monitor) NewBlockEnevts(ks []cid.Cid, l int) {
 		be.NumOfRedundantReqs = 0
 		be.NumOfRedundantBlks = 0
 		be.lock = new(sync.RWMutex)
-		m.EventList.Store(c, be)
+		m.EventList.Store(c, &be)
 	}
 	m.TotalBlocks += len(ks)
 	m.TotalFetches++
@@ -113,7 +113,7 @@ func (m *Monitor) BlockServiceGet(c cid.Cid) {
 		return
 	}
 	if v, ok := m.EventList.Load(c); ok {
-		be := v.(BlockEvent)
+		be := v.(*BlockEvent)
 		be.BlockServiceGet = time.Now()
 		m.EventList.Store(c, be)
 	}
@@ -125,7 +125,7 @@ func (m *Monitor) BlockServiceGets(ks []cid.Cid) {
 	t := time.Now()
 	for _, c := range ks {
 		if v, ok := m.EventList.Load(c); ok {
-			be := v.(BlockEvent)
+			be := v.(*BlockEvent)
 			be.BlockServiceGet = t
 			m.EventList.Store(c, be)
 		}
@@ -137,7 +137,7 @@ func (m *Monitor) BitswapGet(c cid.Cid) {
 		return
 	}
 	if v, ok := m.EventList.Load(c); ok {
-		be := v.(BlockEvent)
+		be := v.(*BlockEvent)
 		be.GetBlocksRequest = time.Now()
 		m.EventList.Store(c, be)
 	}
@@ -149,7 +149,7 @@ func (m *Monitor) ReceiveBlock(c cid.Cid, p string) {
 	//fmt.Printf("ReceiveBlock %s %s %s\n", c, p, time.Now())
 	value, ok := m.EventList.Load(c)
 	if ok {
-		be := value.(BlockEvent)
+		be := value.(*BlockEvent)
 		if be.FirstReceive == ZeroTime {
 			be.FirstReceive = time.Now()
 			be.ReceiveFrom = p
@@ -168,7 +168,7 @@ func (m *Monitor) PutStore(blk cid.Cid) {
 		return
 	}
 	if v, ok := m.EventList.Load(blk); ok {
-		be := v.(BlockEvent)
+		be := v.(*BlockEvent)
 		if be.FirstPutStore == ZeroTime {
 			be.FirstPutStore = time.Now()
 			m.EventList.Store(blk, be)
@@ -182,7 +182,7 @@ func (m *Monitor) SendWant(c cid.Cid, p string) {
 	//fmt.Printf("SendWantTo %s %s %s\n", c, p, time.Now())
 	v, ok := m.EventList.Load(c)
 	if ok {
-		be := v.(BlockEvent)
+		be := v.(*BlockEvent)
 
 		// FirstReceive is nonzero means that we have received the
 		// wanted block with the cid c at FirstReceive. So this want
@@ -210,7 +210,7 @@ func (m *Monitor) FindProviders(c cid.Cid) {
 	//fmt.Printf("FindProviders %s %s\n", c, time.Now())
 	v, ok := m.EventList.Load(c)
 	if ok {
-		be := v.(BlockEvent)
+		be := v.(*BlockEvent)
 		if be.FirstFindProvider == ZeroTime {
 			be.FirstFindProvider = time.Now()
 			m.EventList.Store(c, be)
@@ -223,14 +223,14 @@ func (m *Monitor) FoundProvide(mh string, p string) {
 		return
 	}
 	//fmt.Printf("FoundProvide %s %s %s\n", mh, p, time.Now())
-	var be BlockEvent
+	var be *BlockEvent
 	var c cid.Cid
 	found := false
 	m.EventList.Range(func(key, value interface{}) bool {
 		hash := key.(cid.Cid).Hash()
 		if hash.String() == mh {
 			c = key.(cid.Cid)
-			be = value.(BlockEvent)
+			be = value.(*BlockEvent)
 			found = true
 			return false
 		}
@@ -249,7 +249,7 @@ func (m *Monitor) BeginVisit(c cid.Cid) {
 		return
 	}
 	if v, ok := m.EventList.Load(c); ok {
-		be := v.(BlockEvent)
+		be := v.(*BlockEvent)
 		be.BeginVisit = time.Now()
 		m.EventList.Store(c, be)
 	}
@@ -259,7 +259,7 @@ func (m *Monitor) FinishVisit(c cid.Cid) {
 		return
 	}
 	if v, ok := m.EventList.Load(c); ok {
-		be := v.(BlockEvent)
+		be := v.(*BlockEvent)
 		be.FinishVisit = time.Now()
 		m.EventList.Store(c, be)
 	}
@@ -289,7 +289,7 @@ func (m *Monitor) GetBreakdown() BreakdownTimeForGet {
 	}
 
 	m.EventList.Range(func(key, value interface{}) bool {
-		be := value.(BlockEvent)
+		be := value.(*BlockEvent)
 		rootblk := false
 		if key.(cid.Cid) == m.Root {
 			rootblk = true
@@ -418,7 +418,7 @@ func (m *Monitor) blkWantToTarget(c cid.Cid) time.Time {
 		return ZeroTime
 	}
 	if v, ok := m.EventList.Load(c); ok {
-		be := v.(BlockEvent)
+		be := v.(*BlockEvent)
 		if v, ok = be.FirstWantTo.Load(be.ReceiveFrom); ok {
 			return v.(time.Time)
 		}
@@ -430,7 +430,7 @@ func (m *Monitor) blkGotProviderTarget(c cid.Cid) time.Time {
 		return ZeroTime
 	}
 	if v, ok := m.EventList.Load(c); ok {
-		be := v.(BlockEvent)
+		be := v.(*BlockEvent)
 		if v, ok = be.FirstGotProvider.Load(be.ReceiveFrom); ok {
 			return v.(time.Time)
 		}
@@ -447,7 +447,7 @@ func (m *Monitor) TimeStamps() {
 	fmt.Printf("BlockserviceGet-GetBlocksRequest-FirstFindProvider-FirstGotProvider-FirstWantTo-FirstReceive-PutStore-BeginVisit-FinishVisit\n")
 	m.EventList.Range(func(key, value interface{}) bool {
 		cid := key.(cid.Cid)
-		be := value.(BlockEvent)
+		be := value.(*BlockEvent)
 		// fmt.Printf("%s ", cid)
 		if value := be.BlockServiceGet; value != ZeroTime {
 			fmt.Printf("%.2f ", value.Sub(m.GetStartTime).Seconds()*1000)
@@ -506,7 +506,7 @@ func (m *Monitor) SumBlksRedundant() int {
 	}
 	sum := 0
 	m.EventList.Range(func(key, value interface{}) bool {
-		be := value.(BlockEvent)
+		be := value.(*BlockEvent)
 		sum += be.NumOfRedundantBlks
 		return true
 	})
@@ -519,7 +519,7 @@ func (m *Monitor) SumReqsRedundant() int {
 	}
 	sum := 0
 	m.EventList.Range(func(key, value interface{}) bool {
-		be := value.(BlockEvent)
+		be := value.(*BlockEvent)
 		sum += be.NumOfRedundantReqs
 		return true
 	})
@@ -532,3 +532,35 @@ func (be *BlockEvent) SetLevel(l int) {
 	}
 	be.Level = l
 }
+
+// Senders returns the number of distinct peers that delivered blocks of the monitored file.
+func (m *Monitor) Senders() int {
+	if !CMD_EnableMetrics {
+		return 0
+	}
+	senders := make(map[string]bool)
+	m.EventList.Range(func(key, value interface{}) bool {
+		be := value.(*BlockEvent)
+		if be.ReceiveFrom != "" {
+			senders[be.ReceiveFrom] = true
+		}
+		return true
+	})
+	return len(senders)
+}
+
+// ReceivedBlocks returns the distinct blocks of the monitored file that arrived from other peers.
+func (m *Monitor) ReceivedBlocks() []cid.Cid {
+	if !CMD_EnableMetrics {
+		return nil
+	}
+	var received []cid.Cid
+	m.EventList.Range(func(key, value interface{}) bool {
+		be := value.(*BlockEvent)
+		if be.FirstReceive != ZeroTime {
+			received = append(received, key.(cid.Cid))
+		}
+		return true
+	})
+	return received
+}
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// PrometheusPrefix is prepended to the name of every exported metric.
+var PrometheusPrefix = "xipfs_"
+
+// PrometheusQuantiles are the quantiles reported for every histogram and timer.
+var PrometheusQuantiles = []float64{0.5, 0.9, 0.99, 0.999}
+
+/*
+WritePrometheus writes all metrics of the registry in the Prometheus text exposition format (version 0.0.4):
+
+	Counter:        counter <name>_total
+	Gauge:          gauge <name>
+	Meter:          counter <name>_total, gauge <name>_rate1m (events/s)
+	Histogram:      summary <name>{quantile=...}, <name>_sum, <name>_count, gauge <name>_max
+	Timer:          summary <name>_seconds{quantile=...}, <name>_seconds_sum, <name>_seconds_count, gauge <name>_seconds_max
+	LatencyHistogram: like Timer
+
+Names are sanitized to [a-zA-Z0-9_:], metrics whose sanitized names collide get a numeric suffix.
+*/
+func WritePrometheus(w io.Writer, r metrics.Registry) error {
+	all := make(map[string]interface{})
+	r.Each(func(name string, m interface{}) {
+		all[name] = m
+	})
+	if r == metrics.DefaultRegistry {
+		eachLatency(func(name string, h *LatencyHistogram) {
+			all[name] = h
+		})
+	}
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	used := make(map[string]bool)
+	for _, name := range names {
+		pname := PrometheusPrefix + sanitizeMetricName(name)
+		for i := 1; used[pname]; i++ {
+			pname = fmt.Sprintf("%s%s_%d", PrometheusPrefix, sanitizeMetricName(name), i)
+		}
+		used[pname] = true
+
+		switch m := all[name].(type) {
+		case metrics.Counter:
+			writeSample(bw, pname+"_total", "counter", float64(m.Count()))
+		case metrics.Gauge:
+			writeSample(bw, pname, "gauge", float64(m.Value()))
+		case metrics.GaugeFloat64:
+			writeSample(bw, pname, "gauge", m.Value())
+		case metrics.Meter:
+			s := m.Snapshot()
+			writeSample(bw, pname+"_total", "counter", float64(s.Count()))
+			writeSample(bw, pname+"_rate1m", "gauge", s.Rate1())
+		case metrics.Histogram:
+			s := m.Snapshot()
+			writeSummary(bw, pname, s.Percentiles(PrometheusQuantiles), float64(s.Sum()), s.Count(), float64(s.Max()), 1)
+		case metrics.Timer:
+			s := m.Snapshot()
+			writeSummary(bw, pname+"_seconds", s.Percentiles(PrometheusQuantiles), float64(s.Sum()), s.Count(), float64(s.Max()), float64(time.Second))
+		case *LatencyHistogram:
+			writeSummary(bw, pname+"_seconds", m.Percentiles(PrometheusQuantiles), float64(m.Sum()), m.Count(), float64(m.Max()), float64(time.Second))
+		}
+	}
+	return bw.Flush()
+}
+
+func writeSample(w io.Writer, name, typ string, v float64) {
+	fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, v)
+}
+
+func writeSummary(w io.Writer, name string, ps []float64, sum float64, count int64, max float64, unit float64) {
+	fmt.Fprintf(w, "# TYPE %s summary\n", name)
+	for i, q := range PrometheusQuantiles {
+		fmt.Fprintf(w, "%s{quantile=\"%v\"} %v\n", name, q, ps[i]/unit)
+	}
+	fmt.Fprintf(w, "%s_sum %v\n", name, sum/unit)
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+	writeSample(w, name+"_max", "gauge", max/unit)
+}
+
+func sanitizeMetricName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9' && i > 0:
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// StartMetricsServer serves the default registry at http://<addr>/metrics in the background, so that long-running
+// nodes can be scraped by Prometheus while they work.
+func StartMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := WritePrometheus(w, metrics.DefaultRegistry); err != nil {
+			fmt.Printf("failed to write metrics: %s\n", err.Error())
+		}
+	})
+	go func() {
+		fmt.Printf("metrics exposed at http://%s/metrics\n", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Printf("failed to serve metrics on %s: %s\n", addr, err.Error())
+		}
+	}()
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	r := metrics.NewRegistry()
+	timer := metrics.NewTimer()
+	r.Register("GetNode", timer)
+	histogram := metrics.NewHistogram(metrics.NewUniformSample(1024))
+	r.Register("FP Variance", histogram)
+	counter := metrics.NewCounter()
+	r.Register("blocks", counter)
+	for i := 1; i <= 100; i++ {
+		timer.Update(time.Duration(i) * time.Millisecond)
+		histogram.Update(int64(i))
+	}
+	counter.Inc(7)
+
+	var out bytes.Buffer
+	if err := WritePrometheus(&out, r); err != nil {
+		t.Fatal(err)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(&out)
+	if err != nil {
+		t.Fatalf("output does not parse: %s\n%s", err, out.String())
+	}
+
+	checkSummary := func(name string, median, sum float64) {
+		t.Helper()
+		f, ok := families[name]
+		if !ok {
+			t.Fatalf("no family %s", name)
+		}
+		if f.GetType() != dto.MetricType_SUMMARY {
+			t.Fatalf("%s is a %s, expected a summary", name, f.GetType())
+		}
+		s := f.GetMetric()[0].GetSummary()
+		if s.GetSampleCount() != 100 {
+			t.Errorf("%s count %d, expected 100", name, s.GetSampleCount())
+		}
+		if math.Abs(s.GetSampleSum()-sum) > 1e-9 {
+			t.Errorf("%s sum %v, expected %v", name, s.GetSampleSum(), sum)
+		}
+		qs := s.GetQuantile()
+		if len(qs) != len(PrometheusQuantiles) {
+			t.Fatalf("%s has %d quantiles, expected %d", name, len(qs), len(PrometheusQuantiles))
+		}
+		for i, q := range qs {
+			if q.GetQuantile() != PrometheusQuantiles[i] {
+				t.Errorf("%s quantile %d is %v, expected %v", name, i, q.GetQuantile(), PrometheusQuantiles[i])
+			}
+			if i > 0 && q.GetValue() < qs[i-1].GetValue() {
+				t.Errorf("%s quantiles are not monotonic: %v", name, qs)
+			}
+		}
+		if math.Abs(qs[0].GetValue()-median) > median*0.05 {
+			t.Errorf("%s median %v, expected about %v", name, qs[0].GetValue(), median)
+		}
+	}
+	// timers are exported in seconds
+	checkSummary("xipfs_GetNode_seconds", 0.0505, 5.05)
+	checkSummary("xipfs_FP_Variance", 50.5, 5050)
+	if _, ok := families["xipfs_GetNode_seconds_max"]; !ok {
+		t.Error("no max of the timer")
+	}
+
+	c, ok := families["xipfs_blocks_total"]
+	if !ok {
+		t.Fatal("no family xipfs_blocks_total")
+	}
+	if c.GetType() != dto.MetricType_COUNTER {
+		t.Fatalf("xipfs_blocks_total is a %s, expected a counter", c.GetType())
+	}
+	if v := c.GetMetric()[0].GetCounter().GetValue(); v != 7 {
+		t.Errorf("xipfs_blocks_total is %v, expected 7", v)
+	}
+}
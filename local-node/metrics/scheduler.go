@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Schedulers are the names of the block-request schedulers of pbitswap.
+var Schedulers = []string{"xor", "roundrobin", "rarest", "sequential"}
+
+// CMD_PBitswapScheduler is the scheduler of pbitswap downloads that were not given one with WithScheduler.
+var CMD_PBitswapScheduler = "xor"
+
+type schedulerKey struct{}
+
+// WithScheduler makes the pbitswap download run with ctx use the named scheduler, so downloads of one run can be
+// compared under different schedulers.
+func WithScheduler(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, schedulerKey{}, name)
+}
+
+// SchedulerFrom returns the scheduler of the download run with ctx.
+func SchedulerFrom(ctx context.Context) string {
+	if name, ok := ctx.Value(schedulerKey{}).(string); ok {
+		return name
+	}
+	return CMD_PBitswapScheduler
+}
+
+// ParseSchedulers splits a comma-separated list of scheduler names, checking each of them.
+func ParseSchedulers(list string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		known := false
+		for _, s := range Schedulers {
+			known = known || s == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown pbitswap scheduler %q, expected one of %s", name, strings.Join(Schedulers, ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+/*
+BlockTimeline is the life of one block of a get, as recorded by the Monitor, in milliseconds since the get started.
+Steps that did not happen, e.g. the network steps of a block that was already local, are left out. One timeline per
+block written as JSON lines is enough to plot the request waterfall of a file.
+*/
+type BlockTimeline struct {
+	Record          string             `json:"record"`
+	File            string             `json:"file"`
+	Block           string             `json:"block"`
+	Level           int                `json:"level"`
+	BlockService    *float64           `json:"blockservice_ms,omitempty"`
+	Request         *float64           `json:"request_ms,omitempty"`
+	WantTo          map[string]float64 `json:"want_to_ms,omitempty"`
+	FindProvider    *float64           `json:"find_provider_ms,omitempty"`
+	GotProvider     map[string]float64 `json:"got_provider_ms,omitempty"`
+	Receive         *float64           `json:"receive_ms,omitempty"`
+	From            string             `json:"from,omitempty"`
+	PutStore        *float64           `json:"put_store_ms,omitempty"`
+	BeginVisit      *float64           `json:"begin_visit_ms,omitempty"`
+	FinishVisit     *float64           `json:"finish_visit_ms,omitempty"`
+	RedundantReqs   int                `json:"redundant_reqs"`
+	RedundantBlocks int                `json:"redundant_blocks"`
+}
+
+// FileTimeline closes the timelines of the blocks of one get with the times derived from them.
+type FileTimeline struct {
+	Record      string    `json:"record"`
+	File        string    `json:"file"`
+	Start       time.Time `json:"start"`
+	Blocks      int       `json:"blocks"`
+	TTFBMs      float64   `json:"ttfb_ms"`
+	RootMs      float64   `json:"root_ms"`
+	LastBlockMs float64   `json:"last_block_ms"`
+	TotalMs     float64   `json:"total_ms"`
+}
+
+// Timeline returns the timeline of every block of the monitored get, ordered by the time they were requested.
+func (m *Monitor) Timeline(file string) []BlockTimeline {
+	if !CMD_EnableMetrics {
+		return nil
+	}
+	since := func(t time.Time) *float64 {
+		if t == ZeroTime || t.IsZero() {
+			return nil
+		}
+		ms := t.Sub(m.GetStartTime).Seconds() * 1000
+		return &ms
+	}
+	perPeer := func(times *sync.Map) map[string]float64 {
+		ms := make(map[string]float64)
+		times.Range(func(k, v interface{}) bool {
+			ms[k.(string)] = v.(time.Time).Sub(m.GetStartTime).Seconds() * 1000
+			return true
+		})
+		if len(ms) == 0 {
+			return nil
+		}
+		return ms
+	}
+
+	var timeline []BlockTimeline
+	m.EventList.Range(func(key, value interface{}) bool {
+		be := value.(*BlockEvent)
+		timeline = append(timeline, BlockTimeline{
+			Record:          "block",
+			File:            file,
+			Block:           key.(cid.Cid).String(),
+			Level:           be.Level,
+			BlockService:    since(be.BlockServiceGet),
+			Request:         since(be.GetBlocksRequest),
+			WantTo:          perPeer(&be.FirstWantTo),
+			FindProvider:    since(be.FirstFindProvider),
+			GotProvider:     perPeer(&be.FirstGotProvider),
+			Receive:         since(be.FirstReceive),
+			From:            be.ReceiveFrom,
+			PutStore:        since(be.FirstPutStore),
+			BeginVisit:      since(be.BeginVisit),
+			FinishVisit:     since(be.FinishVisit),
+			RedundantReqs:   be.NumOfRedundantReqs,
+			RedundantBlocks: be.NumOfRedundantBlks,
+		})
+		return true
+	})
+	first := func(t BlockTimeline) float64 {
+		for _, ms := range []*float64{t.BlockService, t.Request, t.Receive, t.PutStore, t.BeginVisit} {
+			if ms != nil {
+				return *ms
+			}
+		}
+		return 0
+	}
+	sort.SliceStable(timeline, func(i, j int) bool {
+		if first(timeline[i]) != first(timeline[j]) {
+			return first(timeline[i]) < first(timeline[j])
+		}
+		return timeline[i].Level < timeline[j].Level
+	})
+	return timeline
+}
+
+// TimeToRoot returns how long the root block of the get took to arrive, 0 if it was not fetched from the network.
+func (m *Monitor) TimeToRoot() time.Duration {
+	if !CMD_EnableMetrics {
+		return 0
+	}
+	if v, ok := m.EventList.Load(m.Root); ok {
+		if be := v.(*BlockEvent); be.FirstReceive != ZeroTime {
+			return be.FirstReceive.Sub(m.GetStartTime)
+		}
+	}
+	return 0
+}
+
+// TimeToLastBlock returns how long it took until the last block of the get arrived.
+func (m *Monitor) TimeToLastBlock() time.Duration {
+	if !CMD_EnableMetrics {
+		return 0
+	}
+	last := time.Duration(0)
+	m.EventList.Range(func(key, value interface{}) bool {
+		if be := value.(*BlockEvent); be.FirstReceive != ZeroTime {
+			if d := be.FirstReceive.Sub(m.GetStartTime); d > last {
+				last = d
+			}
+		}
+		return true
+	})
+	return last
+}
+
+// TimelineWriter writes the block timelines of every get to one JSON lines file.
+type TimelineWriter struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+func NewTimelineWriter(w io.Writer) *TimelineWriter {
+	return &TimelineWriter{enc: json.NewEncoder(w)}
+}
+
+// Write writes the timelines of the blocks of one get followed by its FileTimeline. ttfb is measured by the caller,
+// it is when the first byte of content was handed out, which the block events do not tell.
+func (tw *TimelineWriter) Write(m *Monitor, file string, ttfb, total time.Duration) error {
+	if tw == nil || m == nil {
+		return nil
+	}
+	blocks := m.Timeline(file)
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	for _, b := range blocks {
+		if err := tw.enc.Encode(b); err != nil {
+			return err
+		}
+	}
+	return tw.enc.Encode(FileTimeline{
+		Record:      "file",
+		File:        file,
+		Start:       m.GetStartTime,
+		Blocks:      len(blocks),
+		TTFBMs:      ttfb.Seconds() * 1000,
+		RootMs:      m.TimeToRoot().Seconds() * 1000,
+		LastBlockMs: m.TimeToLastBlock().Seconds() * 1000,
+		TotalMs:     total.Seconds() * 1000,
+	})
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+// LinkProfile describes the emulated network conditions of one direction of a link between two nodes.
+type LinkProfile struct {
+	Latency   time.Duration // one-way delay
+	Jitter    time.Duration // uniformly distributed in [-Jitter, +Jitter]
+	Bandwidth float64       // bytes per second, 0 means unlimited
+	Loss      float64       // probability in [0, 1] that a segment is lost and has to be retransmitted
+}
+
+func (l LinkProfile) String() string {
+	bw := "unlimited"
+	if l.Bandwidth > 0 {
+		bw = fmt.Sprintf("%.1fMbit", l.Bandwidth*8/1000/1000)
+	}
+	return fmt.Sprintf("latency %s jitter %s bandwidth %s loss %.2f%%", l.Latency, l.Jitter, bw, l.Loss*100)
+}
+
+/*
+NetemMatrix assigns every testnet node to a region and every pair of regions to a LinkProfile, read from a file like:
+
+	# region of node 0, 1, 2, ... (reused round-robin if there are more nodes)
+	nodes singapore frankfurt virginia
+	# link <region> <region> <latency> <jitter> <bandwidth> <loss>
+	link singapore frankfurt 80ms 5ms 100mbit 0.5%
+	link singapore virginia 110ms 10ms 100mbit 1%
+	# all other pairs, including two nodes of the same region
+	default 100ms 10ms 0 0-5%
+
+Latency and jitter are one-way Go durations. Bandwidth is 0 (unlimited) or a number with a kbit/mbit/gbit suffix.
+Loss is a percentage, or a range "a-b%" from which every pair of nodes draws its own rate, like
+tools/packet_loss_setup.sh does for every host.
+*/
+type NetemMatrix struct {
+	Regions []string
+	links   map[[2]string]linkSpec
+	dflt    linkSpec
+
+	lock  sync.Mutex
+	rng   *rand.Rand
+	drawn map[[2]int]LinkProfile
+}
+
+// linkSpec is a LinkProfile whose loss may still be a range.
+type linkSpec struct {
+	LinkProfile
+	maxLoss float64
+}
+
+// loadNetemMatrix reads a matrix file, see NetemMatrix for the format.
+func loadNetemMatrix(path string) (*NetemMatrix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netem matrix %s: %s", path, err)
+	}
+	defer f.Close()
+
+	m := &NetemMatrix{
+		links: make(map[[2]string]linkSpec),
+		rng:   seededRand("netem", 0),
+		drawn: make(map[[2]int]LinkProfile),
+	}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "nodes":
+			m.Regions = append(m.Regions, fields[1:]...)
+		case "link":
+			if len(fields) != 7 {
+				return nil, fmt.Errorf("%s:%d: expected link <region> <region> <latency> <jitter> <bandwidth> <loss>", path, line)
+			}
+			spec, err := parseLinkSpec(fields[3:])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+			}
+			m.links[regionPair(fields[1], fields[2])] = spec
+		case "default":
+			if len(fields) != 5 {
+				return nil, fmt.Errorf("%s:%d: expected default <latency> <jitter> <bandwidth> <loss>", path, line)
+			}
+			m.dflt, err = parseLinkSpec(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown directive %q", path, line, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read netem matrix %s: %s", path, err)
+	}
+	return m, nil
+}
+
+// Region returns the region of the i-th node.
+func (m *NetemMatrix) Region(i int) string {
+	if len(m.Regions) == 0 {
+		return ""
+	}
+	return m.Regions[i%len(m.Regions)]
+}
+
+// Link returns the profile between nodes a and b. A loss range is drawn once per pair, so both directions and
+// repeated calls agree.
+func (m *NetemMatrix) Link(a, b int) LinkProfile {
+	if a > b {
+		a, b = b, a
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if l, ok := m.drawn[[2]int{a, b}]; ok {
+		return l
+	}
+	spec, ok := m.links[regionPair(m.Region(a), m.Region(b))]
+	if !ok {
+		spec = m.dflt
+	}
+	l := spec.LinkProfile
+	if spec.maxLoss > l.Loss {
+		l.Loss += m.rng.Float64() * (spec.maxLoss - l.Loss)
+	}
+	m.drawn[[2]int{a, b}] = l
+	return l
+}
+
+func regionPair(a, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+func parseLinkSpec(fields []string) (linkSpec, error) {
+	var spec linkSpec
+	var err error
+	if spec.Latency, err = time.ParseDuration(fields[0]); err != nil {
+		return spec, fmt.Errorf("invalid latency %q", fields[0])
+	}
+	if spec.Jitter, err = time.ParseDuration(fields[1]); err != nil {
+		return spec, fmt.Errorf("invalid jitter %q", fields[1])
+	}
+	if spec.Bandwidth, err = parseBandwidth(fields[2]); err != nil {
+		return spec, err
+	}
+
+	loss := strings.TrimSuffix(fields[3], "%")
+	bounds := strings.SplitN(loss, "-", 2)
+	if spec.Loss, err = strconv.ParseFloat(bounds[0], 64); err != nil {
+		return spec, fmt.Errorf("invalid loss %q", fields[3])
+	}
+	spec.maxLoss = spec.Loss
+	if len(bounds) == 2 {
+		if spec.maxLoss, err = strconv.ParseFloat(bounds[1], 64); err != nil {
+			return spec, fmt.Errorf("invalid loss %q", fields[3])
+		}
+	}
+	if spec.Loss < 0 || spec.maxLoss > 100 || spec.Loss > spec.maxLoss {
+		return spec, fmt.Errorf("loss %q out of range 0-100%%", fields[3])
+	}
+	spec.Loss /= 100
+	spec.maxLoss /= 100
+	return spec, nil
+}
+
+// parseBandwidth converts "0", "500kbit", "100mbit" or "1gbit" into bytes per second.
+func parseBandwidth(s string) (float64, error) {
+	v := strings.ToLower(s)
+	unit := 1.0
+	for _, u := range []struct {
+		suffix string
+		bits   float64
+	}{{"kbit", 1e3}, {"mbit", 1e6}, {"gbit", 1e9}, {"bit", 1}} {
+		if strings.HasSuffix(v, u.suffix) {
+			v = strings.TrimSuffix(v, u.suffix)
+			unit = u.bits
+			break
+		}
+	}
+	bw, err := strconv.ParseFloat(v, 64)
+	if err != nil || bw < 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q", s)
+	}
+	return bw * unit / 8, nil
+}
+
+// netemMinRTO is the smallest retransmission timeout of the Linux TCP stack, a lost segment costs at least that.
+const netemMinRTO = 200 * time.Millisecond
+
+// netemSegment is the largest chunk forwarded at once, so bandwidth and loss apply to segment-sized units.
+const netemSegment = 16 * 1024
+
+/*
+NetemProxy is a TCP proxy on loopback that forwards every accepted connection to target, applying a LinkProfile to
+both directions. Testnet nodes dial each other through a proxy per pair instead of directly, which emulates WAN links
+without root or tc.
+
+TCP streams can not lose bytes, so a lost segment is modeled as its retransmission: it is delivered one
+retransmission timeout (max(200ms, 2*latency)) late, holding back everything behind it.
+*/
+type NetemProxy struct {
+	listener net.Listener
+	target   string
+	link     LinkProfile
+
+	lock     sync.Mutex
+	conns    []net.Conn
+	outbound map[string]bool // local host:port of every connection to target
+	rng      *rand.Rand
+}
+
+// StartNetemProxy listens on a random loopback port and starts forwarding to target (host:port) in the background.
+// rng draws its jitter and losses.
+func StartNetemProxy(target string, link LinkProfile, rng *rand.Rand) (*NetemProxy, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &NetemProxy{
+		listener: l,
+		target:   target,
+		link:     link,
+		outbound: make(map[string]bool),
+		rng:      rng,
+	}
+	go p.serve()
+	return p, nil
+}
+
+// Multiaddr is the address other nodes dial to reach the target through the proxy.
+func (p *NetemProxy) Multiaddr() (multiaddr.Multiaddr, error) {
+	addr := p.listener.Addr().(*net.TCPAddr)
+	return multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", addr.Port))
+}
+
+// Forwards reports whether addr (host:port) is either end of the emulated link: the address the proxy listens on, or
+// the source address of one of its connections to target.
+func (p *NetemProxy) Forwards(addr string) bool {
+	if addr == p.listener.Addr().String() {
+		return true
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.outbound[addr]
+}
+
+// Close stops accepting connections and closes all forwarded ones.
+func (p *NetemProxy) Close() {
+	p.listener.Close()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+func (p *NetemProxy) serve() {
+	for {
+		in, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		// the testnet nodes only accept connections from 127.0.0.1, see netemConfig
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+		out, err := dialer.Dial("tcp", p.target)
+		if err != nil {
+			fmt.Printf("netem: failed to dial %s: %s\n", p.target, err.Error())
+			in.Close()
+			continue
+		}
+		p.lock.Lock()
+		p.conns = append(p.conns, in, out)
+		p.outbound[out.LocalAddr().String()] = true
+		p.lock.Unlock()
+		go p.forward(out, in)
+		go p.forward(in, out)
+	}
+}
+
+type netemChunk struct {
+	data    []byte
+	deliver time.Time
+}
+
+// forward copies src to dst, delivering every segment once it went through the emulated link.
+func (p *NetemProxy) forward(dst, src net.Conn) {
+	chunks := make(chan netemChunk, 256)
+	go func() {
+		defer close(chunks)
+		var free, last time.Time
+		for {
+			buf := make([]byte, netemSegment)
+			n, err := src.Read(buf)
+			if n > 0 {
+				now := time.Now()
+				// the segment has to wait for the link to finish serializing everything before it
+				if free.Before(now) {
+					free = now
+				}
+				if p.link.Bandwidth > 0 {
+					free = free.Add(time.Duration(float64(n) / p.link.Bandwidth * float64(time.Second)))
+				}
+				deliver := free.Add(p.delay())
+				// TCP delivers in order, a segment never overtakes the one before it
+				if deliver.Before(last) {
+					deliver = last
+				}
+				last = deliver
+				chunks <- netemChunk{data: buf[:n], deliver: deliver}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for c := range chunks {
+		time.Sleep(time.Until(c.deliver))
+		if _, err := dst.Write(c.data); err != nil {
+			// the other side is gone, unblock the reader and drain what it already queued
+			src.Close()
+			for range chunks {
+			}
+			return
+		}
+	}
+	// pass the EOF on once everything before it was delivered
+	if tcp, ok := dst.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// delay draws the propagation delay of one segment, including a possible retransmission.
+func (p *NetemProxy) delay() time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	d := p.link.Latency
+	if p.link.Jitter > 0 {
+		d += time.Duration((p.rng.Float64()*2 - 1) * float64(p.link.Jitter))
+	}
+	if d < 0 {
+		d = 0
+	}
+	rto := 2 * p.link.Latency
+	if rto < netemMinRTO {
+		rto = netemMinRTO
+	}
+	for p.link.Loss > 0 && p.rng.Float64() < p.link.Loss {
+		d += rto
+		rto *= 2
+	}
+	return d
+}
+
+// tcpTarget returns host:port of the first TCP/IPv4 address among addrs.
+func tcpTarget(addrs []multiaddr.Multiaddr) (string, error) {
+	for _, a := range addrs {
+		ip, err := a.ValueForProtocol(multiaddr.P_IP4)
+		if err != nil {
+			continue
+		}
+		port, err := a.ValueForProtocol(multiaddr.P_TCP)
+		if err != nil {
+			continue
+		}
+		return net.JoinHostPort(ip, port), nil
+	}
+	return "", fmt.Errorf("no tcp address among %v", addrs)
+}
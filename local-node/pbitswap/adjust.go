@@ -164,22 +164,10 @@ func (da *DynamicAdjuster) Adjust5(hr float64, d time.Duration, n int) int {
 	currentEfficiency := float64(n) / d.Seconds()
 	logger.Debugf("当前效率: %f 块/秒 \n", currentEfficiency)
 
-	// 估算带宽，并动态调整请求数量
-	estimatedBandwidth := float64(n) / d.Seconds()
-	if estimatedBandwidth > 0 {
-		if currentEfficiency < estimatedBandwidth*0.8 {
-			da.L = int(float64(da.L) * 1.2) // 增加请求数量
-		} else if currentEfficiency > estimatedBandwidth {
-			da.L = int(float64(da.L) * 0.8) // 减少请求数量
-		}
-	}
-
-	// 更新平均效率数据
-	x, exist := da.averageEfficiency[da.L]
-	if exist {
-		x.in(currentEfficiency)
-		da.averageEfficiency[da.L] = x
-	}
+	// 更新平均效率数据，按本批次请求时的L记录
+	x := da.averageEfficiency[da.L]
+	x.in(currentEfficiency)
+	da.averageEfficiency[da.L] = x
 
 	// 如果历史效率明显高于当前效率，则减小L值
 	if da.lastEfficiency > currentEfficiency*1.5 {
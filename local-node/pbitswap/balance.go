@@ -0,0 +1,211 @@
+package pbitswap
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// weight of the latest batch in the moving averages of a worker
+const balanceAlpha = 0.3
+
+/*
+balancer measures every worker of a download from the batches it requests, the time to the first block (RTT) and the
+blocks per second until the batch completed (throughput), and with -pbbalance balances the download across them:
+
+  - share scales the batch of a worker by its throughput relative to the mean of the workers, and caps it at its
+    proportional share of the blocks still missing, so the workers finish at about the same time.
+  - stealable lets a worker re-request a Pending block only if it would deliver it before the worker that has it in
+    flight, so fast workers that run out of Empty blocks take over the tail of slow ones instead of duplicating
+    requests at random.
+
+Batches of a worker overlap, so throughput is a lower bound of what the provider delivers; it is only compared across
+the workers of the same download. Workers are identified by their index.
+*/
+type balancer struct {
+	lock    sync.Mutex
+	workers []*workerStats
+	pending map[cid.Cid]pendingBlock
+	steals  int
+}
+
+type workerStats struct {
+	rtt        time.Duration
+	throughput float64 // blocks per second
+	samples    int
+	inflight   int
+}
+
+// pendingBlock is the worker that requested a block last and when it is expected to deliver it
+type pendingBlock struct {
+	worker int
+	due    time.Time
+}
+
+func newBalancer() *balancer {
+	return &balancer{pending: make(map[cid.Cid]pendingBlock)}
+}
+
+func (b *balancer) stats(worker int) *workerStats {
+	for len(b.workers) <= worker {
+		b.workers = append(b.workers, &workerStats{})
+	}
+	return b.workers[worker]
+}
+
+// eta returns how long the worker takes to deliver k more blocks, MaxWaitTime if no worker was measured yet
+func (b *balancer) eta(worker, k int) time.Duration {
+	s := b.stats(worker)
+	rtt, throughput := s.rtt, s.throughput
+	if s.samples == 0 {
+		rtt, throughput = b.mean()
+	}
+	if throughput <= 0 {
+		return MaxWaitTime
+	}
+	return rtt + time.Duration(float64(k)/throughput*float64(time.Second))
+}
+
+// mean returns the mean RTT and throughput of the workers measured so far
+func (b *balancer) mean() (time.Duration, float64) {
+	var rtt time.Duration
+	var throughput float64
+	n := 0
+	for _, s := range b.workers {
+		if s.samples > 0 {
+			rtt += s.rtt
+			throughput += s.throughput
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	return rtt / time.Duration(n), throughput / float64(n)
+}
+
+func (b *balancer) weight(worker int) float64 {
+	if s := b.stats(worker); s.samples > 0 {
+		return s.throughput
+	}
+	if _, throughput := b.mean(); throughput > 0 {
+		return throughput
+	}
+	return 1
+}
+
+// throughput returns the measured throughput of the worker, the mean of the workers if it was not measured yet
+func (b *balancer) throughput(worker int) float64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.weight(worker)
+}
+
+// owner returns the worker that requested block c last
+func (b *balancer) owner(c cid.Cid) (int, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	p, ok := b.pending[c]
+	if !ok {
+		return -1, false
+	}
+	return p.worker, true
+}
+
+// requested records a batch the worker requested
+func (b *balancer) requested(worker int, cids []cid.Cid) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	s := b.stats(worker)
+	for _, c := range cids {
+		if old, ok := b.pending[c]; ok && old.worker != worker {
+			b.steals++
+		}
+		s.inflight++
+		b.pending[c] = pendingBlock{worker: worker, due: now.Add(b.eta(worker, s.inflight))}
+	}
+}
+
+// sample records a batch of n blocks the worker is done with: received of them arrived, the first one after rtt and
+// the last one after elapsed. Batches that were cut short by the end of the download only leave the inflight count.
+func (b *balancer) sample(worker, n, received int, rtt, elapsed time.Duration, complete bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s := b.stats(worker)
+	s.inflight -= n
+	if s.inflight < 0 {
+		s.inflight = 0
+	}
+	if !complete || elapsed <= 0 {
+		return
+	}
+	throughput := float64(received) / elapsed.Seconds()
+	if received == 0 {
+		// nothing arrived, the worker is at least as slow as the wait was long
+		rtt = elapsed
+	}
+	if s.samples == 0 {
+		s.rtt, s.throughput = rtt, throughput
+	} else {
+		s.rtt = time.Duration(balanceAlpha*float64(rtt) + (1-balanceAlpha)*float64(s.rtt))
+		s.throughput = balanceAlpha*throughput + (1-balanceAlpha)*s.throughput
+	}
+	s.samples++
+}
+
+// filled forgets a block that arrived
+func (b *balancer) filled(c cid.Cid) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.pending, c)
+}
+
+// share returns the batch size of the worker, n scaled by its weight, at most its share of the left blocks
+func (b *balancer) share(worker, n, left int) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	w := b.weight(worker)
+	total := 0.0
+	for i := range b.workers {
+		total += b.weight(i)
+	}
+	if total <= 0 {
+		return n
+	}
+	mean := total / float64(len(b.workers))
+	size := int(math.Round(float64(n) * w / mean))
+	if limit := int(math.Ceil(float64(left) * w / total)); size > limit {
+		size = limit
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// stealable reports whether the worker would deliver the Pending block c before the worker that requested it
+func (b *balancer) stealable(worker int, c cid.Cid, now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	p, ok := b.pending[c]
+	if !ok {
+		return true
+	}
+	if p.worker == worker {
+		return false
+	}
+	return p.due.After(now.Add(b.eta(worker, b.stats(worker).inflight+1)))
+}
+
+// report logs the measurements of every worker
+func (b *balancer) report() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for i, s := range b.workers {
+		logger.Debugf("worker %d: rtt %s, throughput %.1f blk/s, %d batches", i, s.rtt, s.throughput, s.samples)
+	}
+	logger.Debugf("%d pending blocks were re-requested from another worker", b.steals)
+}
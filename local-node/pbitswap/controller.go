@@ -0,0 +1,293 @@
+package pbitswap
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"metrics"
+)
+
+const (
+	// MaxBatch bounds the batch size any controller can choose
+	MaxBatch = 256
+	// bbrWindow is the number of batches the bbr controller takes the delivery rate and RTT from
+	bbrWindow = 10
+)
+
+// BatchSample is a batch a worker completed.
+type BatchSample struct {
+	Requested int
+	Received  int // blocks that arrived, including redundant ones
+	Redundant int // blocks that another worker delivered first
+	RTT       time.Duration
+	Elapsed   time.Duration
+}
+
+func (s BatchSample) unique() int {
+	return s.Received - s.Redundant
+}
+
+/*
+BatchController decides how many blocks the worker of a provider requests at once (requestEachTime). Every worker has
+its own controller, chosen by -pbcontroller:
+
+	ratio:   shrinks the batch with the share of unique blocks once it drops below 0.7 (the original pbitswap heuristic)
+	aimd:    additive increase while the hit ratio of a batch is above HitRatioThreshold, multiplicative decrease below
+	adjust5: DynamicAdjuster.Adjust5, which averages the delivery rate of every batch size it tried, goes back to the best
+	         one once the current size falls clearly behind it and grows the batch by one otherwise
+	adjust6: DynamicAdjuster.Adjust6, which follows the redundant and received ratios of each batch
+	bbr:     the bandwidth-delay product of the provider, like BBR
+
+The worker bounds the batch with bound.
+*/
+type BatchController interface {
+	Name() string
+	// Init returns the first batch size, max is the MaxRequest of the worker
+	Init(max int) int
+	// Grow returns the batch size after the download discovered deeper levels of the DAG and raised the MaxRequest of
+	// the worker to max. It keeps what the controller learned so far.
+	Grow(max int) int
+	// Received returns the batch size after a block arrived, redundant if another worker delivered it first
+	Received(redundant bool) int
+	// Done returns the batch size after a batch completed
+	Done(s BatchSample) int
+}
+
+// NewBatchController returns a new controller of the given name, one of metrics.Controllers.
+func NewBatchController(name string) (BatchController, error) {
+	switch name {
+	case "", "ratio":
+		return &ratioController{}, nil
+	case "aimd":
+		return &aimdController{}, nil
+	case "adjust5":
+		return &adjusterController{name: "adjust5", da: NewDynamicAdjuster()}, nil
+	case "adjust6":
+		return &adjusterController{name: "adjust6", da: NewDynamicAdjuster()}, nil
+	case "bbr":
+		return &bbrController{startup: true}, nil
+	}
+	return nil, fmt.Errorf("unknown pbitswap batch controller %q", name)
+}
+
+// bound keeps a batch size within [L0, MaxBatch]
+func bound(n int) int {
+	if n < L0 {
+		return L0
+	}
+	if n > MaxBatch {
+		return MaxBatch
+	}
+	return n
+}
+
+// newController returns the controller of -pbcontroller for a new worker.
+func newController() BatchController {
+	c, err := NewBatchController(metrics.CMD_PBitswapController)
+	if err != nil {
+		logger.Warnf("%s, using ratio", err)
+		return &ratioController{}
+	}
+	return c
+}
+
+type ratioController struct {
+	max      int
+	L        int
+	received int
+	desired  int
+}
+
+func (r *ratioController) Name() string { return "ratio" }
+
+func (r *ratioController) Init(max int) int {
+	r.max, r.L = max, max
+	return r.L
+}
+
+func (r *ratioController) Grow(max int) int {
+	r.max = max
+	if r.received == 0 || float64(r.desired)/float64(r.received) >= 0.7 {
+		r.L = max
+	} else {
+		r.L = int(float64(max) * float64(r.desired) / float64(r.received))
+	}
+	return r.L
+}
+
+func (r *ratioController) Received(redundant bool) int {
+	r.received++
+	if !redundant {
+		r.desired++
+	}
+	uniquentRatio := float64(r.desired) / float64(r.received)
+	if uniquentRatio < 0.7 {
+		r.L = int(float64(r.max) * uniquentRatio)
+	}
+	return r.L
+}
+
+func (r *ratioController) Done(s BatchSample) int {
+	return r.L
+}
+
+type aimdController struct {
+	L       int
+	batches int
+}
+
+func (a *aimdController) Name() string { return "aimd" }
+
+func (a *aimdController) Init(max int) int {
+	a.L = max
+	return a.L
+}
+
+// Grow starts from the larger max only if no batch completed yet
+func (a *aimdController) Grow(max int) int {
+	if a.batches == 0 {
+		a.L = max
+	}
+	return a.L
+}
+
+func (a *aimdController) Received(redundant bool) int {
+	return a.L
+}
+
+func (a *aimdController) Done(s BatchSample) int {
+	if s.Requested == 0 {
+		return a.L
+	}
+	a.batches++
+	if float64(s.unique())/float64(s.Requested) < HitRatioThreshold {
+		a.L = bound(a.L / DEC0)
+	} else {
+		a.L = bound(a.L + INC1)
+	}
+	return a.L
+}
+
+// adjusterController runs one of the policies of DynamicAdjuster
+type adjusterController struct {
+	name    string
+	da      *DynamicAdjuster
+	batches int
+}
+
+func (a *adjusterController) Name() string { return a.name }
+
+func (a *adjusterController) Init(max int) int {
+	a.da.L = max
+	return a.da.L
+}
+
+// Grow starts from the larger max only if no batch completed yet
+func (a *adjusterController) Grow(max int) int {
+	if a.batches == 0 {
+		a.da.L = max
+	}
+	return a.da.L
+}
+
+func (a *adjusterController) Received(redundant bool) int {
+	return a.da.L
+}
+
+func (a *adjusterController) Done(s BatchSample) int {
+	if s.Requested == 0 || s.Elapsed <= 0 {
+		return a.da.L
+	}
+	a.batches++
+	if a.name == "adjust5" {
+		a.da.L = bound(a.da.Adjust5(float64(s.unique())/float64(s.Requested), s.Elapsed, s.unique()))
+		return a.da.L
+	}
+	return a.da.Adjust6(s.Requested, s.Received, s.Redundant, s.Elapsed)
+}
+
+// bbr cycles its gain over the batches, probing for more bandwidth in one of them and draining the queue it built up in
+// the next
+var bbrGains = []float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+/*
+bbrController sizes the batch to twice the bandwidth-delay product of the provider: the highest delivery rate of unique
+blocks of the last bbrWindow batches times the lowest RTT, the time to the first block. It starts by doubling the batch
+until the delivery rate stopped growing by 25% for three batches.
+*/
+type bbrController struct {
+	L       int
+	rates   []float64
+	rtts    []time.Duration
+	startup bool
+	best    float64
+	plateau int
+	cycle   int
+}
+
+func (b *bbrController) Name() string { return "bbr" }
+
+func (b *bbrController) Init(max int) int {
+	b.L = max
+	return b.L
+}
+
+// Grow starts from the larger max only if no batch completed yet, the bandwidth-delay product does not depend on it
+func (b *bbrController) Grow(max int) int {
+	if len(b.rates) == 0 {
+		b.L = max
+	}
+	return b.L
+}
+
+func (b *bbrController) Received(redundant bool) int {
+	return b.L
+}
+
+func (b *bbrController) Done(s BatchSample) int {
+	if s.Elapsed <= 0 {
+		return b.L
+	}
+	b.rates = append(b.rates, float64(s.unique())/s.Elapsed.Seconds())
+	if len(b.rates) > bbrWindow {
+		b.rates = b.rates[1:]
+	}
+	if s.RTT > 0 {
+		b.rtts = append(b.rtts, s.RTT)
+		if len(b.rtts) > bbrWindow {
+			b.rtts = b.rtts[1:]
+		}
+	}
+	btlBw := 0.0
+	for _, r := range b.rates {
+		btlBw = math.Max(btlBw, r)
+	}
+
+	if b.startup {
+		if btlBw >= b.best*1.25 {
+			b.best = btlBw
+			b.plateau = 0
+		} else {
+			b.plateau++
+		}
+		if b.plateau < 3 {
+			b.L = bound(b.L * 2)
+			return b.L
+		}
+		b.startup = false
+	}
+	if len(b.rtts) == 0 {
+		return b.L
+	}
+	rtProp := b.rtts[0]
+	for _, r := range b.rtts {
+		if r < rtProp {
+			rtProp = r
+		}
+	}
+	gain := bbrGains[b.cycle%len(bbrGains)]
+	b.cycle++
+	b.L = bound(int(math.Ceil(2 * gain * btlBw * rtProp.Seconds())))
+	return b.L
+}
@@ -9,6 +9,7 @@ import (
 
 	"metrics"
 
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	format "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log"
@@ -27,6 +28,10 @@ type Dispatcher struct {
 	queryState     map[cid.Cid]int
 	queryStateLock sync.RWMutex
 	cids           []cid.Cid
+	order          map[cid.Cid]int // index of each block in cids, guarded by queryStateLock
+	requests       map[cid.Cid]int // number of workers that requested each block, guarded by queryStateLock
+	level          map[cid.Cid]int // depth of each block in the DAG, the children of the root are level 1, guarded by queryStateLock
+	emptyAt        map[int]int     // number of Empty blocks of each level, guarded by queryStateLock
 	left           int32
 	wantBlocksEach int
 
@@ -38,11 +43,16 @@ type Dispatcher struct {
 	routing  routing.ContentRouting
 	rootNode format.NavigableNode
 
-	worker  *sync.Map
-	monitor *DispatchMonitor
+	worker    *sync.Map
+	workers   int32
+	monitor   *DispatchMonitor
+	scheduler Scheduler
+	balance   *balancer
+	endgame   *endgame
 
 	writeNodeLock *sync.Mutex
 	collectedblk  int
+	start         time.Time
 }
 
 // NewDisPatcher creates a dispatcher for file fetching
@@ -53,9 +63,17 @@ func NewDisPatcher(ctx context.Context, root format.NavigableNode) *Dispatcher {
 		wantBlocksEach: 10,
 		queryState:     make(map[cid.Cid]int),
 		cids:           []cid.Cid{},
+		order:          make(map[cid.Cid]int),
+		requests:       make(map[cid.Cid]int),
+		level:          make(map[cid.Cid]int),
+		emptyAt:        make(map[int]int),
 		monitor:        NewMonitor(),
+		scheduler:      schedulerFor(ctx),
+		balance:        newBalancer(),
+		endgame:        newEndgame(),
 		writeNodeLock:  new(sync.Mutex),
 		worker:         new(sync.Map),
+		start:          time.Now(),
 	}
 	result.routing = result.path[0].GetGetter().(format.PeerGetter).GetRouting()
 	result.selfID = result.routing.(routing.ProviderManagerRouting).SelfID()
@@ -70,27 +88,40 @@ const (
 )
 
 
-// 修改 blkFind 函数
-func (d *Dispatcher) blkFind(cids []cid.Cid) {
-    add := int32(0)
-    for _, c := range cids {
-        d.queryStateLock.Lock()  // 写操作加锁
-        _, has := d.queryState[c]
-        if !has {
-            d.queryState[c] = Empty
-            d.cids = append(d.cids, c)
-            add++
-        }
-        d.queryStateLock.Unlock()
-    }
-    
-    atomic.AddInt32(&d.left, add)
-
-    // 并行调度块
-    d.worker.Range(func(key, value interface{}) bool {
-        go value.(*peerToDispatch).absorb2(cids, d.selfID)
-        return true
-    })
+// blkFind adds the blocks of a level of the DAG that were discovered and schedules them to the workers. Both happen
+// under queryStateLock, so a worker that addWorker registers meanwhile gets the level either way.
+func (d *Dispatcher) blkFind(cids []cid.Cid, level int) {
+	d.queryStateLock.Lock()
+	add := d.blkAdd(cids, level)
+	atomic.AddInt32(&d.left, add)
+	d.blkSchedule(cids)
+	d.queryStateLock.Unlock()
+}
+
+// blkAdd adds the blocks that are new to queryState and returns how many there were, the caller holds queryStateLock
+func (d *Dispatcher) blkAdd(cids []cid.Cid, level int) int32 {
+	add := int32(0)
+	for _, c := range cids {
+		_, has := d.queryState[c]
+		if !has {
+			d.queryState[c] = Empty
+			d.order[c] = len(d.cids)
+			d.level[c] = level
+			d.emptyAt[level]++
+			d.cids = append(d.cids, c)
+			add++
+		}
+	}
+	return add
+}
+
+// blkSchedule hands discovered blocks to every worker, the caller holds queryStateLock
+func (d *Dispatcher) blkSchedule(cids []cid.Cid) {
+	// 并行调度块
+	d.worker.Range(func(key, value interface{}) bool {
+		go value.(*peerToDispatch).absorb2(cids, d.selfID)
+		return true
+	})
 }
 
 // 修改 blkFill 函数
@@ -108,10 +139,59 @@ func (d *Dispatcher) blkPending(cids []cid.Cid) {
 	d.queryStateLock.Lock()
 	defer d.queryStateLock.Unlock()
 	for _, c := range cids {
+		// a block that arrived while it was picked stays Filled
+		switch d.queryState[c] {
+		case Filled:
+			continue
+		case Empty:
+			d.emptyAt[d.level[c]]--
+		}
 		d.queryState[c] = Pending
+		d.requests[c]++
 	}
 }
 
+// blkIndex returns the position of a block in the order the download found the blocks
+func (d *Dispatcher) blkIndex(c cid.Cid) int {
+	d.queryStateLock.RLock()
+	defer d.queryStateLock.RUnlock()
+	return d.order[c]
+}
+
+// blkLevel returns the depth of a block in the DAG
+func (d *Dispatcher) blkLevel(c cid.Cid) int {
+	d.queryStateLock.RLock()
+	defer d.queryStateLock.RUnlock()
+	return d.level[c]
+}
+
+// blkFrontier returns the shallowest level of the DAG that has Empty blocks, 0 if there is none
+func (d *Dispatcher) blkFrontier() int {
+	d.queryStateLock.RLock()
+	defer d.queryStateLock.RUnlock()
+	frontier := 0
+	for level, n := range d.emptyAt {
+		if n > 0 && (frontier == 0 || level < frontier) {
+			frontier = level
+		}
+	}
+	return frontier
+}
+
+// blkNumber returns the number of blocks of the DAG discovered so far, the root excluded
+func (d *Dispatcher) blkNumber() uint64 {
+	d.queryStateLock.RLock()
+	defer d.queryStateLock.RUnlock()
+	return uint64(len(d.cids))
+}
+
+// blkRequests returns how many times a block was requested
+func (d *Dispatcher) blkRequests(c cid.Cid) int {
+	d.queryStateLock.RLock()
+	defer d.queryStateLock.RUnlock()
+	return d.requests[c]
+}
+
 // 修改 blkQuery 函数
 func (d *Dispatcher) blkQuery(c cid.Cid) (int, bool) {
     d.queryStateLock.RLock()  // 读操作加锁
@@ -140,6 +220,7 @@ var dispatcher_close bool
 // Dispatch3 runs the dispatcher loop, continuously fetching and assigning blocks to peers
 func (d *Dispatcher) Dispatch3(visit format.Visitor) error {
 	dispatcher_close = false
+	logger.Debugf("dispatching with scheduler %s", d.scheduler.Name())
 
 	err := visit(d.path[0])
 	if err != nil {
@@ -147,19 +228,25 @@ func (d *Dispatcher) Dispatch3(visit format.Visitor) error {
 	}
 	rootNode := d.path[0].GetIPLDNode()
 
-	blkNumber, _ := rootNode.Size()
-	blkNumber = blkNumber / 256 / 1024
-
+	// deeper levels are discovered as their parents arrive, workers size their batches by the blocks known so far
 	childs := d.path[0].GetChilds()
 	if len(childs) == 0 {
 		return format.EndOfDag
 	} else {
-		d.blkFind(childs)
+		d.blkFind(childs, 1)
 	}
 
 	providers := make(chan peer.ID, 100)
 	finish := make(chan peer.ID)
 
+	// the endgame looks for tail blocks to hedge, a nil channel never fires
+	var endgameTick <-chan time.Time
+	if metrics.CMD_PBitswapEndgame > 0 {
+		ticker := time.NewTicker(EndgameInterval)
+		defer ticker.Stop()
+		endgameTick = ticker.C
+	}
+
 	go d.findProviders(rootNode, providers)
 	if !metrics.CMD_DisCoWorer {
 		go d.findCoWorkers(providers)
@@ -176,9 +263,7 @@ func (d *Dispatcher) Dispatch3(visit format.Visitor) error {
 			if prov != d.selfID {
 				// Create a new worker for this provider if not already created
 				if _, ok := d.worker.Load(prov); !ok {
-					newworker := d.newPeerToDispatch(prov, d.cids, d.path[0].GetGetter(), finish, visit)
-					newworker.InitRequestBlkNumber(blkNumber)
-					d.worker.Store(prov, newworker)
+					d.addWorker(prov, finish, visit)
 				}
 
 				worker, _ := d.worker.Load(prov)
@@ -196,6 +281,9 @@ func (d *Dispatcher) Dispatch3(visit format.Visitor) error {
 			if d.blkAllFilled() {
 				dispatcher_close = true
 				d.cancle()
+				d.balance.report()
+				d.endgame.report(d.monitor)
+				d.report()
 				return nil
 			}
 			// allends := true
@@ -213,6 +301,9 @@ func (d *Dispatcher) Dispatch3(visit format.Visitor) error {
 			// 	return nil
 			// }
 
+		case <-endgameTick:
+			d.hedgeTail()
+
 		case <-d.ctx.Done():
 			return nil
 		}
@@ -273,11 +364,26 @@ func (d *Dispatcher) findCoWorkers(providers chan peer.ID) {
 	}
 }
 
+// addWorker creates the worker of a provider and hands it the blocks discovered so far. They are copied and the worker
+// registered in one critical section, so each level blkFind adds is either in the copy or scheduled to the worker.
+func (d *Dispatcher) addWorker(prov peer.ID, finish chan peer.ID, visit format.Visitor) *peerToDispatch {
+	worker := d.newPeerToDispatch(prov, nil, d.path[0].GetGetter(), finish, visit)
+	d.queryStateLock.RLock()
+	blks := make([]cid.Cid, len(d.cids))
+	copy(blks, d.cids)
+	d.worker.Store(prov, worker)
+	d.queryStateLock.RUnlock()
+	worker.absorb2(blks, d.selfID)
+	worker.InitRequestBlkNumber(uint64(len(blks)))
+	return worker
+}
+
 func (d *Dispatcher) newPeerToDispatch(p peer.ID, blks []cid.Cid, theGetter format.NodeGetter, finishchan chan peer.ID, visitFunc format.Visitor) *peerToDispatch {
 	//fmt.Printf("new Worker for peer %s, got target %v\n",p,blks)
 
 	result := &peerToDispatch{
 		id:              p,
+		index:           int(atomic.AddInt32(&d.workers, 1)) - 1,
 		distances:       new(sync.Map),
 		sequence:        []cid.Cid{},
 		requestEachTime: 10,
@@ -290,9 +396,24 @@ func (d *Dispatcher) newPeerToDispatch(p peer.ID, blks []cid.Cid, theGetter form
 		effective:       0,
 		lock:            new(sync.Mutex),
 		workinglock:     new(sync.Mutex),
-		da:              NewDynamicAdjuster(),
+		hedgeCh:         make(chan blocks.Block, EndgameHedges),
+		batchCh:         make(chan BatchSample, 1),
+		controller:      newController(),
 		working:         false,
 	}
 	result.absorb2(blks, d.selfID)
 	return result
 }
+
+// report logs the shape of the DAG the download fetched
+func (d *Dispatcher) report() {
+	d.queryStateLock.RLock()
+	defer d.queryStateLock.RUnlock()
+	depth := 0
+	for level := range d.emptyAt {
+		if level > depth {
+			depth = level
+		}
+	}
+	logger.Debugf("fetched a DAG of %d blocks below the root over %d levels", len(d.cids), depth)
+}
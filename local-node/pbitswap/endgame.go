@@ -0,0 +1,197 @@
+package pbitswap
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"metrics"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+const (
+	// EndgameHedges is the number of workers a tail block is requested from besides the one that has it in flight
+	EndgameHedges = 2
+	// EndgameInterval is how often the dispatcher looks for tail blocks to hedge
+	EndgameInterval = 300 * time.Millisecond
+)
+
+/*
+endgame hedges the tail of a download. Once no more than -pbendgame blocks are missing, every Pending block is requested
+again from the EndgameHedges fastest other workers, by the throughput the balancer measured. Whichever request delivers
+first wins and the others are cancelled: the hedged requests right away, and a batch of regular requests once all of
+its blocks arrived. The redundancy this costs is counted in the DispatchMonitor.
+*/
+type endgame struct {
+	active int32
+
+	lock    sync.Mutex
+	hedges  map[cid.Cid]map[int]context.CancelFunc // by worker index
+	batches map[cid.Cid][]*batch
+}
+
+// batch is a request of regular blocks that can be cancelled once none of them is missing any more
+type batch struct {
+	left   int
+	cancel context.CancelFunc
+}
+
+func newEndgame() *endgame {
+	return &endgame{
+		hedges:  make(map[cid.Cid]map[int]context.CancelFunc),
+		batches: make(map[cid.Cid][]*batch),
+	}
+}
+
+func (e *endgame) isActive() bool {
+	return atomic.LoadInt32(&e.active) == 1
+}
+
+// track returns the context to request the blocks of a batch with, cancelled when all of them arrived
+func (e *endgame) track(ctx context.Context, cids []cid.Cid) context.Context {
+	if metrics.CMD_PBitswapEndgame <= 0 {
+		return ctx
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	b := &batch{left: len(cids), cancel: cancel}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, c := range cids {
+		e.batches[c] = append(e.batches[c], b)
+	}
+	return ctx
+}
+
+// settle cancels the requests for block c that lost to the one of the worker
+func (d *Dispatcher) settle(c cid.Cid, worker int) {
+	e := d.endgame
+	if metrics.CMD_PBitswapEndgame <= 0 {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, b := range e.batches[c] {
+		b.left--
+		if b.left == 0 {
+			b.cancel()
+		}
+	}
+	delete(e.batches, c)
+
+	hedges := e.hedges[c]
+	_, won := hedges[worker]
+	cancelled := 0
+	for w, cancel := range hedges {
+		if w != worker {
+			cancelled++
+		}
+		cancel()
+	}
+	delete(e.hedges, c)
+	if won {
+		d.monitor.updateHedgeWin()
+	}
+	d.monitor.updateHedgeCancels(cancelled)
+}
+
+// hedgeTail hedges the Pending blocks once the download is in its endgame
+func (d *Dispatcher) hedgeTail() {
+	left := atomic.LoadInt32(&d.left)
+	if left == 0 || int(left) > metrics.CMD_PBitswapEndgame {
+		return
+	}
+	e := d.endgame
+	if atomic.CompareAndSwapInt32(&e.active, 0, 1) {
+		logger.Debugf("endgame: %d blocks left", left)
+	}
+
+	// workers that are running, fastest first
+	var workers []*peerToDispatch
+	d.worker.Range(func(key, value interface{}) bool {
+		p := value.(*peerToDispatch)
+		p.workinglock.Lock()
+		if p.working {
+			workers = append(workers, p)
+		}
+		p.workinglock.Unlock()
+		return true
+	})
+	speed := make(map[int]float64, len(workers))
+	for _, p := range workers {
+		speed[p.index] = d.balance.throughput(p.index)
+	}
+	sort.SliceStable(workers, func(i, j int) bool {
+		return speed[workers[i].index] > speed[workers[j].index]
+	})
+
+	d.queryStateLock.RLock()
+	var pending []cid.Cid
+	for _, c := range d.cids {
+		if d.queryState[c] == Pending {
+			pending = append(pending, c)
+		}
+	}
+	d.queryStateLock.RUnlock()
+
+	for _, c := range pending {
+		owner, _ := d.balance.owner(c)
+		e.lock.Lock()
+		hedges, ok := e.hedges[c]
+		if !ok {
+			hedges = make(map[int]context.CancelFunc)
+			e.hedges[c] = hedges
+		}
+		issued := 0
+		for _, p := range workers {
+			if len(hedges) >= EndgameHedges {
+				break
+			}
+			if _, has := hedges[p.index]; has || p.index == owner {
+				continue
+			}
+			ctx, cancel := context.WithCancel(d.workctx)
+			hedges[p.index] = cancel
+			issued++
+			go p.hedge(ctx, c)
+		}
+		e.lock.Unlock()
+		if issued > 0 {
+			d.blkPending([]cid.Cid{c})
+			d.monitor.updateHedges(issued)
+			logger.Debugf("endgame: hedged %s with %d workers", c, issued)
+		}
+	}
+}
+
+// hedge requests block c from the peer on behalf of the endgame and hands it to the worker loop
+func (p *peerToDispatch) hedge(ctx context.Context, c cid.Cid) {
+	blks := p.getter.(format.PeerGetter).GetBlocksFrom(ctx, []cid.Cid{c}, p.id)
+	var blk blocks.Block
+	var ok bool
+	select {
+	case blk, ok = <-blks:
+		if !ok {
+			return
+		}
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case p.hedgeCh <- blk:
+	case <-ctx.Done():
+	}
+}
+
+// report logs what the endgame cost
+func (e *endgame) report(m *DispatchMonitor) {
+	if !e.isActive() {
+		return
+	}
+	hedges, wins, cancels, redundants := m.GetHedges()
+	logger.Debugf("endgame: %d hedged requests, %d won, %d cancelled, %d redundant blocks", hedges, wins, cancels, redundants)
+}
@@ -2,6 +2,7 @@ package pbitswap
 
 import (
 	"fmt"
+	"sync/atomic"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 )
@@ -9,6 +10,13 @@ import (
 type DispatchMonitor struct {
 	redundants int
 	effects    map[peer.ID]int
+
+	// endgame, updated atomically: hedged requests issued, those that delivered first and the losing ones cancelled,
+	// and the redundant blocks received during the endgame, the price of hedging
+	hedges            int32
+	hedgeWins         int32
+	hedgeCancels      int32
+	endgameRedundants int32
 }
 
 func NewMonitor() *DispatchMonitor {
@@ -30,9 +38,31 @@ func (m *DispatchMonitor) updateEffects(p peer.ID, e int) {
 
 }
 
+func (m *DispatchMonitor) updateHedges(n int) {
+	atomic.AddInt32(&m.hedges, int32(n))
+}
+
+func (m *DispatchMonitor) updateHedgeWin() {
+	atomic.AddInt32(&m.hedgeWins, 1)
+}
+
+func (m *DispatchMonitor) updateHedgeCancels(n int) {
+	atomic.AddInt32(&m.hedgeCancels, int32(n))
+}
+
+func (m *DispatchMonitor) updateEndgameRedundant() {
+	atomic.AddInt32(&m.endgameRedundants, 1)
+}
+
 func (m *DispatchMonitor) GetRedundants() int {
 	return m.redundants
 }
+
+// GetHedges returns the hedged requests of the endgame, how many of them won and were cancelled, and the redundant
+// blocks received during the endgame
+func (m *DispatchMonitor) GetHedges() (hedges, wins, cancels, redundants int) {
+	return int(atomic.LoadInt32(&m.hedges)), int(atomic.LoadInt32(&m.hedgeWins)), int(atomic.LoadInt32(&m.hedgeCancels)), int(atomic.LoadInt32(&m.endgameRedundants))
+}
 func (m *DispatchMonitor) GetEffectsVariance() float64 {
 	total := 0.0
 	n := 0.0
@@ -52,4 +82,6 @@ func (m *DispatchMonitor) GetEffectsVariance() float64 {
 func (m *DispatchMonitor) collect() {
 	fmt.Printf("redundant count %d\n", m.redundants)
 	fmt.Printf("Variance :%f\n", m.GetEffectsVariance())
+	hedges, wins, cancels, redundants := m.GetHedges()
+	fmt.Printf("hedged requests %d, won %d, cancelled %d, endgame redundant count %d\n", hedges, wins, cancels, redundants)
 }
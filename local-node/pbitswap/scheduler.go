@@ -0,0 +1,187 @@
+package pbitswap
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"metrics"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+/*
+Scheduler decides which blocks the worker of each provider requests next. Every worker keeps the blocks of the
+download in a sequence ordered by Key, and asks Pick for its next batch whenever it has room for more requests.
+
+	xor:        the blocks closest to self and the provider by twoXorDistance first, so workers spread over the
+	            file without coordinating (the original pbitswap order)
+	roundrobin: worker k of n takes the blocks with index k, k+n, k+2n, ... before any other block
+	rarest:     blocks nobody requested yet, then the pending blocks requested from the fewest providers, the in-flight
+	            form of rarest-first since pbitswap does not learn which provider holds which block
+	sequential: blocks in the order the download found them, which is file order within each level of the DAG, for
+	            streaming
+
+Except for rarest, all of them request blocks nobody requested yet before re-requesting pending ones, and all of them
+take the Empty blocks of the shallowest level of the DAG first (see pick). With -pbbalance a worker only re-requests
+the pending blocks it would deliver before the worker that has them in flight.
+*/
+type Scheduler interface {
+	Name() string
+	// Key places block c, the index-th block the download found, in the sequence of the worker of provider p.
+	Key(self, p peer.ID, c cid.Cid, index int) int64
+	// Pick returns up to n blocks of seq, the sequence of the worker-th worker, to request next.
+	Pick(d *Dispatcher, seq []cid.Cid, worker, n int) []cid.Cid
+}
+
+// NewScheduler returns the scheduler of the given name, one of metrics.Schedulers.
+func NewScheduler(name string) (Scheduler, error) {
+	switch name {
+	case "", "xor":
+		return xorScheduler{}, nil
+	case "roundrobin":
+		return roundRobinScheduler{}, nil
+	case "rarest":
+		return rarestScheduler{}, nil
+	case "sequential":
+		return sequentialScheduler{}, nil
+	}
+	return nil, fmt.Errorf("unknown pbitswap scheduler %q", name)
+}
+
+// pass selects the blocks of a sequence in the given state for which keep, if set, holds.
+type pass struct {
+	state int
+	keep  func(c cid.Cid) bool
+}
+
+/*
+pick takes up to n blocks of seq for the worker-th worker, running through it once per pass. The Empty passes run once
+more before, restricted to the frontier, the shallowest level of the DAG with Empty blocks: its intermediate nodes reveal
+the blocks below them, so fetching them first lets the download discover the DAG level by level as early as possible.
+*/
+func (d *Dispatcher) pick(seq []cid.Cid, worker, n int, passes ...pass) []cid.Cid {
+	var result []cid.Cid
+	taken := make(map[cid.Cid]bool)
+	now := time.Now()
+	run := func(ps pass, level int) bool {
+		for _, c := range seq {
+			if len(result) >= n {
+				return true
+			}
+			if taken[c] {
+				continue
+			}
+			v, ok := d.blkQuery(c)
+			if !ok {
+				fmt.Println("peerToDispatch ask for non-exists cid")
+				return false
+			}
+			if level > 0 && d.blkLevel(c) != level {
+				continue
+			}
+			if v == Pending && metrics.CMD_PBitswapBalance && !d.balance.stealable(worker, c, now) {
+				continue
+			}
+			if v == ps.state && (ps.keep == nil || ps.keep(c)) {
+				result = append(result, c)
+				taken[c] = true
+			}
+		}
+		return true
+	}
+	if frontier := d.blkFrontier(); frontier > 0 {
+		for _, ps := range passes {
+			if ps.state == Empty && !run(ps, frontier) {
+				return nil
+			}
+		}
+	}
+	for _, ps := range passes {
+		if !run(ps, 0) {
+			return nil
+		}
+	}
+	return result
+}
+
+type xorScheduler struct{}
+
+func (xorScheduler) Name() string { return "xor" }
+
+func (xorScheduler) Key(self, p peer.ID, c cid.Cid, index int) int64 {
+	return twoXorDistance(self, p, c)
+}
+
+func (xorScheduler) Pick(d *Dispatcher, seq []cid.Cid, worker, n int) []cid.Cid {
+	return d.pick(seq, worker, n, pass{state: Empty}, pass{state: Pending})
+}
+
+type roundRobinScheduler struct{}
+
+func (roundRobinScheduler) Name() string { return "roundrobin" }
+
+func (roundRobinScheduler) Key(self, p peer.ID, c cid.Cid, index int) int64 {
+	return int64(index)
+}
+
+// Pick stripes over the workers there are now, a worker that joins later takes over a stripe of its own.
+func (roundRobinScheduler) Pick(d *Dispatcher, seq []cid.Cid, worker, n int) []cid.Cid {
+	workers := int(atomic.LoadInt32(&d.workers))
+	if workers < 1 {
+		workers = 1
+	}
+	stripe := func(c cid.Cid) bool {
+		return d.blkIndex(c)%workers == worker%workers
+	}
+	return d.pick(seq, worker, n, pass{Empty, stripe}, pass{state: Empty}, pass{Pending, stripe}, pass{state: Pending})
+}
+
+type rarestScheduler struct{}
+
+func (rarestScheduler) Name() string { return "rarest" }
+
+func (rarestScheduler) Key(self, p peer.ID, c cid.Cid, index int) int64 {
+	return int64(index)
+}
+
+func (rarestScheduler) Pick(d *Dispatcher, seq []cid.Cid, worker, n int) []cid.Cid {
+	candidates := d.pick(seq, worker, len(seq), pass{state: Empty}, pass{state: Pending})
+	requests := make(map[cid.Cid]int, len(candidates))
+	for _, c := range candidates {
+		requests[c] = d.blkRequests(c)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return requests[candidates[i]] < requests[candidates[j]]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+type sequentialScheduler struct{}
+
+func (sequentialScheduler) Name() string { return "sequential" }
+
+func (sequentialScheduler) Key(self, p peer.ID, c cid.Cid, index int) int64 {
+	return int64(index)
+}
+
+func (sequentialScheduler) Pick(d *Dispatcher, seq []cid.Cid, worker, n int) []cid.Cid {
+	return d.pick(seq, worker, n, pass{state: Empty}, pass{state: Pending})
+}
+
+// schedulerFor returns the scheduler the download of ctx was given with metrics.WithScheduler, the one of -scheduler
+// otherwise.
+func schedulerFor(ctx context.Context) Scheduler {
+	s, err := NewScheduler(metrics.SchedulerFrom(ctx))
+	if err != nil {
+		logger.Warnf("%s, using xor", err)
+		return xorScheduler{}
+	}
+	return s
+}
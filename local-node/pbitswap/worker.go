@@ -7,6 +7,8 @@ import (
 	"sync"
 	"time"
 
+	"metrics"
+
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	util "github.com/ipfs/go-ipfs-util"
@@ -17,10 +19,11 @@ import (
 )
 
 type peerToDispatch struct {
-	id peer.ID
+	id    peer.ID
+	index int // the workers of a download are numbered in the order they were created
 
 	sequence        []cid.Cid
-	distances       *sync.Map //distance is mixed with self-cid and provider-cid, used to randomly re-order request sequence
+	distances       *sync.Map //key of the Scheduler, e.g. the distance mixed with self-cid and provider-cid, used to order the request sequence
 	requestEachTime int
 	MaxRequest      int
 
@@ -29,17 +32,21 @@ type peerToDispatch struct {
 	dispatcher *Dispatcher
 	visit      format.Visitor
 
-	finish chan peer.ID
+	finish  chan peer.ID
+	hedgeCh chan blocks.Block // blocks of the hedged requests of the endgame
+	batchCh chan BatchSample  // batches that completed, for the controller
 
 	stopflag bool
 
+	blkNumber uint64 // blocks of the DAG known when MaxRequest was set
+
 	effective int
 
 	lock        *sync.Mutex // 改为读写锁以提高并发
 	workinglock *sync.Mutex
 
-	wg *sync.WaitGroup
-	da *DynamicAdjuster
+	wg         *sync.WaitGroup
+	controller BatchController
 
 	working bool
 
@@ -116,7 +123,7 @@ func twoXorDistance(p1 peer.ID, p2 peer.ID, c cid.Cid) int64 {
 	return d1 + d2
 }
 
-// absord2 reorder blks based on distance definition and update peerToDispatch.sequence
+// absord2 reorder blks based on the key of the Scheduler and update peerToDispatch.sequence
 func (p *peerToDispatch) absorb2(blks []cid.Cid, self peer.ID) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
@@ -125,18 +132,17 @@ func (p *peerToDispatch) absorb2(blks []cid.Cid, self peer.ID) {
 	unadd := make([]cid.Cid, 0)
 	for _, c := range blks {
 		//p.distances[c]=ShortXorDistance(p.id,c)
+		// a block can be linked from several nodes of the DAG, the ones after it are still new
 		_, has := p.distances.Load(c)
 		if !has {
-			p.distances.Store(c, twoXorDistance(self, p.id, c))
+			p.distances.Store(c, p.dispatcher.scheduler.Key(self, p.id, c, p.dispatcher.blkIndex(c)))
 			unadd = append(unadd, c)
-		} else {
-			return
 		}
 	}
 
 	//fmt.Printf("peer %s\n, have %d ,absorb unadd %d\n",p.id,len(p.sequence),len(unadd))
 
-	//re-order request sequence according to distance
+	//re-order request sequence according to key
 	sortsquence := make([]sortItem, len(unadd))
 	for i := 0; i < len(unadd); i++ {
 		sortsquence[i].index = i
@@ -240,54 +246,28 @@ func (p *peerToDispatch) absorb(blks []cid.Cid) {
 	}
 }
 
-// squeeze return peer.requestEachTime cids for requesting
-func (d *Dispatcher) squeeze(peer peerToDispatch) []cid.Cid {
+// squeeze return peer.requestEachTime cids for requesting, chosen by the Scheduler of the download. With -pbbalance the
+// batch is scaled by the throughput of the peer.
+func (d *Dispatcher) squeeze(peer *peerToDispatch) []cid.Cid {
 	//fmt.Printf("peer %s, sequeeze from %d targets\n", peer.id, len(peer.sequence))
-
-	var result []cid.Cid
-	fetched := 0
-	// totalCids := len(peer.sequence)
-	// allowedPending := totalCids / 5 // 不超过1/5的CID可以为Pending
-	// pendingCount := 0
-
-	// 首先处理所有状态为 Empty 的块
-	for _, cid := range peer.sequence {
-		v, ok := d.blkQuery(cid)
-		if !ok {
-			fmt.Println("peerToDispatch ask for non-exists cid")
-			return nil
-		}
-		if v == Empty {
-			result = append(result, cid)
-			fetched++
-			if fetched >= peer.requestEachTime {
-				break
-			}
-		}
+	n := peer.requestEachTime
+	if metrics.CMD_PBitswapBalance {
+		n = d.balance.share(peer.index, n, int(atomic.LoadInt32(&d.left)))
 	}
+	// absorb2 replaces the sequence as new levels arrive, it never changes one in place
+	peer.lock.Lock()
+	sequence := peer.sequence
+	peer.lock.Unlock()
+	return d.scheduler.Pick(d, sequence, peer.index, n)
+}
 
-	// 如果还没有达到需要的块数，再处理 Pending 状态的块，但要限制 Pending 的比例
-	if fetched < peer.requestEachTime {
-		for _, cid := range peer.sequence {
-			v, ok := d.blkQuery(cid)
-			if !ok {
-				fmt.Println("peerToDispatch ask for non-exists cid")
-				return nil
-			}
-			if v == Pending {
-				// 检查当前 Pending 状态的数量是否超过1/5的限制
-				// if pendingCount < allowedPending {
-				result = append(result, cid)
-				// pendingCount++
-				fetched++
-				if fetched >= peer.requestEachTime {
-					break
-				}
-				// }
-			}
-		}
-	}
-	return result
+// request marks a batch as pending and requests it from the peer in a new routine
+func (p *peerToDispatch) request(ctx context.Context, toRequest []cid.Cid, blockCh chan<- blocks.Block, thresholdCh chan<- struct{}, doneCh <-chan struct{}, wg *sync.WaitGroup) {
+	p.request_blks += len(toRequest)
+	p.dispatcher.blkPending(toRequest)
+	p.dispatcher.balance.requested(p.index, toRequest)
+	wg.Add(1)
+	go p.getBlocksFrom(p.dispatcher.endgame.track(ctx, toRequest), toRequest, blockCh, thresholdCh, doneCh, wg)
 }
 
 // run starts the main loop of a peer worker, which is responsible for
@@ -340,16 +320,12 @@ func (p *peerToDispatch) run() {
 	defer ticker.Stop()
 
 	// 启动第一个批次块的获取
-	toRequest := p.dispatcher.squeeze(*p)
+	toRequest := p.dispatcher.squeeze(p)
 	if len(toRequest) == 0 {
 		close(doneCh)
 		return
 	}
-	p.request_blks += len(toRequest)
-	p.dispatcher.blkPending(toRequest)
-
-	wg.Add(1)
-	go p.getBlocksFrom(ctx, toRequest, blockCh, thresholdCh, doneCh, &wg)
+	p.request(ctx, toRequest, blockCh, thresholdCh, doneCh, &wg)
 
 	// 主 routine 开始监听 block 接收和阈值触发信号
 	for {
@@ -364,15 +340,11 @@ func (p *peerToDispatch) run() {
 				p.desired_blks++
 			}
 			// 实时维护冗余块比例并根据比例调整请求宽度
-			uniquentRatio := float64(p.desired_blks) / float64(p.received_blks)
-			if uniquentRatio < 0.7 {
-				p.requestEachTime = int(float64(p.MaxRequest) * uniquentRatio) // 例如：快速缩小请求宽度
-			}
-			if p.requestEachTime < 1 {
-				p.requestEachTime = 1
+			if status != 2 {
+				p.setBatch("block", p.controller.Received(status == 1), nil)
 			}
 
-			logger.Debugf("Worker %s received block %s, status: %d , uniqueRatio: %f, requestEachTime: %d", p.id, blk.Cid(), status, uniquentRatio, p.requestEachTime)
+			logger.Debugf("Worker %s received block %s, status: %d , uniqueRatio: %f, requestEachTime: %d", p.id, blk.Cid(), status, float64(p.desired_blks)/float64(p.received_blks), p.requestEachTime)
 
 			// 判断是否所有块都已接收
 			if p.dispatcher.blkAllFilled() {
@@ -384,23 +356,32 @@ func (p *peerToDispatch) run() {
 				p.finish <- p.id
 			}
 
+		case blk := <-p.hedgeCh:
+			// hedged blocks of the endgame do not count into the request width
+			p.processBlock(blk)
+			if p.dispatcher.blkAllFilled() {
+				closeOnceDone.Do(func() {
+					close(doneCh)
+				})
+				p.finish <- p.id
+			}
+
+		case sample := <-p.batchCh:
+			p.setBatch("batch", p.controller.Done(sample), &sample)
+
 		case <-thresholdCh:
-			toRequest = p.dispatcher.squeeze(*p)
+			p.refreshBlkNumber()
+			toRequest = p.dispatcher.squeeze(p)
 			if len(toRequest) > 0 {
-				p.request_blks += len(toRequest)
-				p.dispatcher.blkPending(toRequest)
-				wg.Add(1)
-				go p.getBlocksFrom(ctx, toRequest, blockCh, thresholdCh, doneCh, &wg)
+				p.request(ctx, toRequest, blockCh, thresholdCh, doneCh, &wg)
 			}
 		case <-ticker.C:
 			// 定时器触发，发起新的块请求
 			// logger.Debugf("Worker %s ticker triggered, sending new block request", p.id)
-			toRequest = p.dispatcher.squeeze(*p)
+			p.refreshBlkNumber()
+			toRequest = p.dispatcher.squeeze(p)
 			if len(toRequest) > 0 {
-				p.request_blks += len(toRequest)
-				p.dispatcher.blkPending(toRequest)
-				wg.Add(1)
-				go p.getBlocksFrom(ctx, toRequest, blockCh, thresholdCh, doneCh, &wg)
+				p.request(ctx, toRequest, blockCh, thresholdCh, doneCh, &wg)
 			}
 		case <-doneCh:
 			// 完成所有块请求
@@ -416,9 +397,25 @@ func (p *peerToDispatch) run() {
 func (p *peerToDispatch) getBlocksFrom(ctx context.Context, toRequest []cid.Cid, blockCh chan<- blocks.Block, thresholdCh chan<- struct{}, doneCh <-chan struct{}, wg *sync.WaitGroup) {
 	logger.Debugf("Worker %s start new routine to send %d block requests to peers: %v", p.id, len(toRequest), toRequest)
 	defer wg.Done()
+	start := time.Now()
 	blocks := p.getter.(format.PeerGetter).GetBlocksFrom(ctx, toRequest, p.id)
 	receivedCount := 0
 	totalCount := len(toRequest)
+	// the balancer and the batch controller learn the RTT and throughput of the peer from the batch
+	var rtt time.Duration
+	redundantCount := 0
+	complete := false
+	defer func() {
+		elapsed := time.Since(start)
+		p.dispatcher.balance.sample(p.index, totalCount, receivedCount, rtt, elapsed, complete)
+		if complete {
+			select {
+			case p.batchCh <- BatchSample{Requested: totalCount, Received: receivedCount, Redundant: redundantCount, RTT: rtt, Elapsed: elapsed}:
+			case <-doneCh:
+			case <-ctx.Done():
+			}
+		}
+	}()
 	preloaded := 0
 	if totalCount <= 1 {
 		preloaded = 1
@@ -430,8 +427,15 @@ func (p *peerToDispatch) getBlocksFrom(ctx context.Context, toRequest []cid.Cid,
 		case blk, ok := <-blocks:
 			if !ok {
 				// 通道关闭，退出
+				complete = true
 				return
 			}
+			if rtt == 0 {
+				rtt = time.Since(start)
+			}
+			if state, _ := p.dispatcher.blkQuery(blk.Cid()); state == Filled {
+				redundantCount++
+			}
 
 			select {
 			case <-doneCh:
@@ -468,9 +472,21 @@ func (p *peerToDispatch) processBlock(blk blocks.Block) int {
 		return 2
 	} else if state == Filled {
 		p.dispatcher.monitor.updateRedundant()
+		if p.dispatcher.endgame.isActive() {
+			p.dispatcher.monitor.updateEndgameRedundant()
+		}
 		return 1
 	}
 	p.dispatcher.queryStateLock.Lock()
+	if p.dispatcher.queryState[blk.Cid()] == Filled {
+		// another worker processed it in the meantime
+		p.dispatcher.queryStateLock.Unlock()
+		p.dispatcher.monitor.updateRedundant()
+		if p.dispatcher.endgame.isActive() {
+			p.dispatcher.monitor.updateEndgameRedundant()
+		}
+		return 1
+	}
 
 	nd, err := format.Decode(blk)
 	if err != nil {
@@ -490,15 +506,23 @@ func (p *peerToDispatch) processBlock(blk blocks.Block) int {
 		p.dispatcher.queryStateLock.Unlock()
 		return 2
 	}
-	p.dispatcher.queryState[blk.Cid()] = Filled
-	atomic.AddInt32(&p.dispatcher.left, -1)
-	p.dispatcher.queryStateLock.Unlock()
-
 	// 处理块的子节点
+	// the children of an intermediate node are added before it counts as filled, so the download cannot seem complete
+	// while the level below it is still unknown
 	childs := navigableNode.GetChilds()
+	add := p.dispatcher.blkAdd(childs, p.dispatcher.level[blk.Cid()]+1)
+	if p.dispatcher.queryState[blk.Cid()] == Empty {
+		p.dispatcher.emptyAt[p.dispatcher.level[blk.Cid()]]--
+	}
+	p.dispatcher.queryState[blk.Cid()] = Filled
+	atomic.AddInt32(&p.dispatcher.left, add-1)
+	// scheduled under the lock like in blkFind, so workers added meanwhile do not miss the children
 	if len(childs) > 0 {
-		p.dispatcher.blkFind(childs)
+		p.dispatcher.blkSchedule(childs)
 	}
+	p.dispatcher.queryStateLock.Unlock()
+	p.dispatcher.balance.filled(blk.Cid())
+	p.dispatcher.settle(blk.Cid(), p.index)
 
 	return 0
 
@@ -508,19 +532,61 @@ func (p *peerToDispatch) Stop() {
 	p.stopflag = true
 }
 
-// InitRequestBlkNumber determines the initial block request batch size of each peer worker, according to given total block number
+// InitRequestBlkNumber determines the initial block request batch size of each peer worker, according to the number of
+// blocks discovered so far
 func (p *peerToDispatch) InitRequestBlkNumber(blkNumber uint64) {
+	p.blkNumber = blkNumber
+	p.MaxRequest = maxRequest(blkNumber)
+	//p.requestEachTime=5
+	p.setBatch("init", p.controller.Init(p.MaxRequest), nil)
+
+}
+
+// refreshBlkNumber raises MaxRequest once the download discovered the deeper levels of the DAG
+func (p *peerToDispatch) refreshBlkNumber() {
+	n := p.dispatcher.blkNumber()
+	if n <= p.blkNumber {
+		return
+	}
+	p.blkNumber = n
+	if max := maxRequest(n); max > p.MaxRequest {
+		p.MaxRequest = max
+		p.setBatch("grow", p.controller.Grow(max), nil)
+	}
+}
+
+func maxRequest(blkNumber uint64) int {
 	if blkNumber <= 1 {
-		p.MaxRequest = 1
-	} else {
-		if blkNumber > 20 {
-			p.MaxRequest = 10
-		} else {
-			p.MaxRequest = int(blkNumber) / 2
-		}
+		return 1
 	}
-	p.requestEachTime = p.MaxRequest
-	//p.requestEachTime=5
-	p.da.L = p.requestEachTime
+	if blkNumber > 20 {
+		return 10
+	}
+	return int(blkNumber) / 2
+}
 
+// setBatch sets the batch size the controller chose and logs it to metrics.BatchLog, on every batch and whenever it
+// changed otherwise
+func (p *peerToDispatch) setBatch(event string, n int, s *BatchSample) {
+	n = bound(n)
+	changed := n != p.requestEachTime
+	p.requestEachTime = n
+	if metrics.BatchLog == nil || (s == nil && !changed && event != "init") {
+		return
+	}
+	b := metrics.BatchSize{
+		Download:   p.dispatcher.path[0].GetIPLDNode().Cid().String(),
+		Worker:     p.id.String(),
+		Controller: p.controller.Name(),
+		Event:      event,
+		Ms:         time.Since(p.dispatcher.start).Seconds() * 1000,
+		Batch:      n,
+	}
+	if s != nil {
+		b.Requested, b.Received, b.Redundant = s.Requested, s.Received, s.Redundant
+		b.RTTMs, b.ElapsedMs = s.RTT.Seconds()*1000, s.Elapsed.Seconds()*1000
+	}
+	if err := metrics.BatchLog.Write(b); err != nil {
+		logger.Warnf("failed to write batch log: %s", err)
+	}
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	PhaseWarmup   = "warmup"
+	PhaseSteady   = "steady"
+	PhaseCooldown = "cooldown"
+)
+
+/*
+Phases splits a benchmark run into three phases:
+
+	warmup:   the first WarmupCount operations, or all operations started within WarmupDuration. Cold DHT lookups and
+	          empty caches land here and are not measured.
+	steady:   measured, lasts Duration (or until the workload is exhausted if Duration is 0).
+	cooldown: no new operations start, the ones still running complete but are not measured.
+
+Commands ask Next before every operation, records are assigned to a phase by their start time. Nothing is reset when
+the steady state begins, operations that are still running would race with it; commands only update their timers for
+operations that are Measured instead.
+*/
+type Phases struct {
+	WarmupCount    int
+	WarmupDuration time.Duration
+	Duration       time.Duration
+
+	lock     sync.Mutex
+	started  time.Time
+	admitted int
+	steady   time.Time
+	end      time.Time
+}
+
+var phases = &Phases{}
+
+// ParsePhases accepts a warmup given as a number of operations ("20") or as a duration ("30s"), empty means none.
+func ParsePhases(warmup string, duration time.Duration) (*Phases, error) {
+	p := &Phases{Duration: duration}
+	if duration < 0 {
+		return nil, fmt.Errorf("invalid duration %s", duration)
+	}
+	if warmup == "" {
+		return p, nil
+	}
+	if n, err := strconv.Atoi(warmup); err == nil && n >= 0 {
+		p.WarmupCount = n
+		return p, nil
+	}
+	d, err := time.ParseDuration(warmup)
+	if err != nil || d < 0 {
+		return nil, fmt.Errorf("invalid warmup %q, expected a number of operations or a duration", warmup)
+	}
+	p.WarmupDuration = d
+	return p, nil
+}
+
+// Next admits one more operation and reports whether it may start, false means the steady state is over.
+func (p *Phases) Next() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	if p.started.IsZero() {
+		p.started = now
+		if p.WarmupCount > 0 || p.WarmupDuration > 0 {
+			fmt.Printf("phase: %s started at %s\n", PhaseWarmup, now)
+		}
+	}
+	if !p.end.IsZero() {
+		return false
+	}
+	p.admitted++
+
+	if p.steady.IsZero() && !p.warmingUp(now) {
+		p.steady = now
+		fmt.Printf("phase: %s started at %s after %d warmup operations\n", PhaseSteady, now, p.admitted-1)
+	}
+	if !p.steady.IsZero() && p.Duration > 0 && now.Sub(p.steady) >= p.Duration {
+		p.end = now
+		fmt.Printf("phase: %s started at %s, %d operations measured\n", PhaseCooldown, now, p.admitted-1)
+		return false
+	}
+	return true
+}
+
+func (p *Phases) warmingUp(now time.Time) bool {
+	if p.WarmupCount > 0 {
+		return p.admitted <= p.WarmupCount
+	}
+	return now.Sub(p.started) < p.WarmupDuration
+}
+
+// Phase returns the phase an operation started at t belongs to. Commands that never call Next are all steady.
+func (p *Phases) Phase(t time.Time) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.started.IsZero() {
+		return PhaseSteady
+	}
+	if p.steady.IsZero() || t.Before(p.steady) {
+		return PhaseWarmup
+	}
+	if !p.end.IsZero() && !t.Before(p.end) {
+		return PhaseCooldown
+	}
+	return PhaseSteady
+}
+
+// Measured reports whether an operation started at t belongs to the steady state.
+func (p *Phases) Measured(t time.Time) bool {
+	return p.Phase(t) == PhaseSteady
+}
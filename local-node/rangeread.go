@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"metrics"
+	"os"
+	"strings"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	icore "github.com/ipfs/interface-go-ipfs-core"
+	icorepath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+/*
+RangeSpec describes the byte-range reads rangedownload issues against every file, like a video player seeking in a
+stream. Each file gets Count reads of Size bytes at offsets drawn from Dist:
+
+	uniform:    anywhere in the file
+	sequential: consecutive ranges from the start, i.e. streaming
+	zipf:       range-aligned offsets with a Zipf distribution, most reads near the start of the file
+	head:       always the first range, the time-to-first-frame case
+*/
+type RangeSpec struct {
+	Dist  string
+	Size  int64
+	Count int
+}
+
+func NewRangeSpec(dist string, size int64, count int) (*RangeSpec, error) {
+	switch dist {
+	case "uniform", "sequential", "zipf", "head":
+	default:
+		return nil, fmt.Errorf("unknown range distribution %q, expected uniform, sequential, zipf or head", dist)
+	}
+	if size <= 0 || count <= 0 {
+		return nil, fmt.Errorf("range reads need a positive -rangesize and -ranges")
+	}
+	return &RangeSpec{Dist: dist, Size: size, Count: count}, nil
+}
+
+// Offsets returns the offsets of the reads of file i, which has fileSize bytes.
+func (r *RangeSpec) Offsets(i int, fileSize int64) []int64 {
+	rng := seededRand("range", i)
+	slots := (fileSize + r.Size - 1) / r.Size
+	if slots < 1 {
+		slots = 1
+	}
+	var zipf *rand.Zipf
+	if r.Dist == "zipf" && slots > 1 {
+		zipf = rand.NewZipf(rng, 1.1, 1, uint64(slots-1))
+	}
+	offsets := make([]int64, r.Count)
+	for j := range offsets {
+		switch r.Dist {
+		case "uniform":
+			if fileSize > r.Size {
+				offsets[j] = rng.Int63n(fileSize - r.Size + 1)
+			}
+		case "sequential":
+			offsets[j] = (int64(j) % slots) * r.Size
+		case "zipf":
+			if zipf != nil {
+				offsets[j] = int64(zipf.Uint64()) * r.Size
+			}
+		}
+	}
+	return offsets
+}
+
+/*
+RangeDownload reads the ranges of RangeSpec from every file of the cid file, each read through a new unixfs reader
+that seeks to its offset. The root block of a file is fetched before its first read, to learn its size.
+
+It records the time to the first byte and to the last byte of every read, and with -enablemetrics compares the blocks
+bitswap fetched during a read (from the Monitor) with the blocks the range needs: the leaves overlapping it and the
+nodes above them. Fetched blocks outside of that set are over-fetch, e.g. by the prefetching of the DAG reader. Blocks
+fetched by earlier reads of the same file are not fetched again.
+*/
+func RangeDownload(ctx context.Context, ipfs icore.CoreAPI, cids string, spec *RangeSpec) {
+	file, err := os.Open(cids)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer file.Close()
+	var roots []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			roots = append(roots, line)
+		}
+	}
+	if !metrics.CMD_EnableMetrics {
+		fmt.Println("over-fetch is only measured with -enablemetrics")
+	}
+
+	latency := metrics.NewLatencyHistogram()
+	ttfb := metrics.NewLatencyHistogram()
+	var needed, fetched, overFetched int
+	for i, root := range roots {
+		p := icorepath.New(root)
+		// the offsets depend on the size of the file, which its root block tells
+		nd, err := ipfs.Unixfs().Get(ctx, p)
+		if err != nil {
+			fmt.Printf("error while get %s: %s\n", root, err.Error())
+			continue
+		}
+		size, _ := nd.Size()
+		nd.Close()
+		for _, offset := range spec.Offsets(i, size) {
+			if !phases.Next() {
+				break
+			}
+			ctx, col := metrics.WithCollector(ctx)
+			start := time.Now()
+			read, first, err := readRange(ctx, ipfs, p, offset, spec.Size)
+			finish := time.Now()
+			if err != nil {
+				col.Discard()
+				results.Op(OpRecord{Op: "range", CID: root, Offset: offset, Start: start, End: finish, Error: err.Error()})
+				fmt.Printf("error while reading %s at %d: %s\n", root, offset, err.Error())
+				break
+			}
+
+			rec := OpRecord{Op: "range", CID: root, Offset: offset, Size: read, Start: start, End: finish, Peers: connectedPeers(ctx, ipfs)}
+			if !first.IsZero() {
+				rec.TTFBMs = first.Sub(start).Seconds() * 1000
+			}
+			if metrics.CMD_EnableMetrics {
+				need, err := rangeBlocks(ctx, ipfs, p, offset, read)
+				if err != nil {
+					fmt.Printf("failed to resolve the blocks of %s at %d: %s\n", root, offset, err.Error())
+				}
+				got := col.Monitor.ReceivedBlocks()
+				rec.NeededBlocks, rec.FetchedBlocks = len(need), len(got)
+				for _, c := range got {
+					if !need[c] {
+						rec.OverFetched++
+					}
+				}
+				rec.Providers = col.Monitor.Senders()
+			}
+			col.Discard()
+			results.Op(rec)
+
+			if phases.Measured(start) {
+				latency.Update(finish.Sub(start))
+				if !first.IsZero() {
+					ttfb.Update(first.Sub(start))
+				}
+				needed += rec.NeededBlocks
+				fetched += rec.FetchedBlocks
+				overFetched += rec.OverFetched
+			}
+			fmt.Printf("range %s [%d, +%d) ttfb %f ms total %f ms needed %d fetched %d over-fetched %d\n",
+				root, offset, read, rec.TTFBMs, finish.Sub(start).Seconds()*1000, rec.NeededBlocks, rec.FetchedBlocks, rec.OverFetched)
+		}
+	}
+
+	fmt.Printf("%s", metrics.StandardOutput("ipfs-range", latency, int(spec.Size)))
+	fmt.Printf("ttfb %s\n", ttfb)
+	if metrics.CMD_EnableMetrics && fetched > 0 {
+		fmt.Printf("blocks needed %d fetched %d over-fetched %d (%.1f%%)\n", needed, fetched, overFetched, float64(overFetched)*100/float64(fetched))
+	}
+	results.Summary()
+}
+
+// readRange reads up to length bytes at offset of the file at p, returning the bytes read and the time the first of
+// them arrived.
+func readRange(ctx context.Context, ipfs icore.CoreAPI, p icorepath.Path, offset, length int64) (int64, time.Time, error) {
+	var first time.Time
+	nd, err := ipfs.Unixfs().Get(ctx, p)
+	if err != nil {
+		return 0, first, err
+	}
+	defer nd.Close()
+	f, ok := nd.(files.File)
+	if !ok {
+		return 0, first, fmt.Errorf("not a file")
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, first, err
+	}
+	buf := make([]byte, 32*1024)
+	read := int64(0)
+	for read < length {
+		if rest := length - read; rest < int64(len(buf)) {
+			buf = buf[:rest]
+		}
+		n, err := f.Read(buf)
+		if n > 0 && first.IsZero() {
+			first = time.Now()
+		}
+		read += int64(n)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return read, first, err
+		}
+	}
+	return read, first, nil
+}
+
+// rangeBlocks returns the blocks of the file at p a reader of [offset, offset+length) has to visit: the leaves that
+// overlap the range and every node on the way down to them. All of them are local after the read.
+func rangeBlocks(ctx context.Context, ipfs icore.CoreAPI, p icorepath.Path, offset, length int64) (map[cid.Cid]bool, error) {
+	resolved, err := ipfs.ResolvePath(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	need := make(map[cid.Cid]bool)
+	var visit func(c cid.Cid, start int64) error
+	visit = func(c cid.Cid, start int64) error {
+		need[c] = true
+		nd, err := ipfs.Dag().Get(ctx, c)
+		if err != nil {
+			return err
+		}
+		pn, ok := nd.(*merkledag.ProtoNode)
+		if !ok {
+			// a raw leaf
+			return nil
+		}
+		fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+		if err != nil {
+			return err
+		}
+		pos := start + int64(len(fsn.Data()))
+		for i, l := range pn.Links() {
+			if i >= fsn.NumChildren() {
+				break
+			}
+			end := pos + int64(fsn.BlockSize(i))
+			if end > offset && pos < offset+length {
+				if err := visit(l.Cid, pos); err != nil {
+					return err
+				}
+			}
+			pos = end
+		}
+		return nil
+	}
+	return need, visit(resolved.Cid(), 0)
+}
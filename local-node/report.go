@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"metrics"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nodeResults is everything read from the result file of one node.
+type nodeResults struct {
+	name      string
+	ops       []OpRecord
+	summaries []SummaryRecord
+	periods   []periodSample
+}
+
+// periodSample is one line of a PeriodLog written by traceDownload: the throughput and latency of the minute before end.
+type periodSample struct {
+	end    time.Time
+	mbps   float64
+	count  int64
+	meanMs float64
+	p99Ms  float64
+}
+
+// periodLogLine matches "<time.Time.String()> throughput count avg p99", the monotonic clock reading is optional.
+var periodLogLine = regexp.MustCompile(`^(\d{4}-\d\d-\d\d \d\d:\d\d:\d\d(?:\.\d+)? [+-]\d{4} \S+)(?: m=\S+)? (\S+) (\d+) (\S+) (\S+)$`)
+
+const periodLogTime = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// loadResults reads a json or csv result file written with -out, or a PeriodLog, recognized by its content.
+func loadResults(path string) (*nodeResults, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	node := &nodeResults{name: filepath.Base(path)}
+	r := bufio.NewReader(f)
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	switch {
+	case first[0] == '{':
+		err = node.loadJSON(r)
+	case first[0] == '#' || first[0] == 'r':
+		err = node.loadCSV(r)
+	default:
+		err = node.loadPeriodLog(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", path, err)
+	}
+	return node, nil
+}
+
+func (n *nodeResults) loadJSON(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var probe struct {
+			Record string `json:"record"`
+		}
+		if err := json.Unmarshal(raw, &probe); err != nil {
+			return err
+		}
+		switch probe.Record {
+		case "op":
+			var rec OpRecord
+			if err := json.Unmarshal(raw, &rec); err != nil {
+				return err
+			}
+			n.ops = append(n.ops, rec)
+		case "summary":
+			var rec SummaryRecord
+			if err := json.Unmarshal(raw, &rec); err != nil {
+				return err
+			}
+			n.summaries = append(n.summaries, rec)
+		}
+	}
+}
+
+func (n *nodeResults) loadCSV(r io.Reader) error {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	columns, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch csvField(columns, row, "record") {
+		case "op":
+			var rec OpRecord
+			if err := csvFill(columns, row, &rec); err != nil {
+				return err
+			}
+			n.ops = append(n.ops, rec)
+		case "summary":
+			var rec SummaryRecord
+			if err := csvFill(columns, row, &rec); err != nil {
+				return err
+			}
+			n.summaries = append(n.summaries, rec)
+		}
+	}
+}
+
+func (n *nodeResults) loadPeriodLog(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		m := periodLogLine.FindStringSubmatch(line)
+		if m == nil {
+			return fmt.Errorf("unrecognized line %q", line)
+		}
+		var s periodSample
+		var err error
+		if s.end, err = time.Parse(periodLogTime, m[1]); err != nil {
+			return err
+		}
+		s.mbps, _ = strconv.ParseFloat(m[2], 64)
+		s.count, _ = strconv.ParseInt(m[3], 10, 64)
+		s.meanMs, _ = strconv.ParseFloat(m[4], 64)
+		s.p99Ms, _ = strconv.ParseFloat(m[5], 64)
+		n.periods = append(n.periods, s)
+	}
+	return scanner.Err()
+}
+
+// measuredOps returns the op records of the given kind that count towards results: steady phase only.
+func (n *nodeResults) measuredOps(op string) []OpRecord {
+	var ops []OpRecord
+	for _, rec := range n.ops {
+		if rec.Op == op && (rec.Phase == "" || rec.Phase == PhaseSteady) {
+			ops = append(ops, rec)
+		}
+	}
+	return ops
+}
+
+// latency returns the latency histogram of one kind of operation: merged from the summaries of the node if they
+// carry one, otherwise rebuilt from its op records.
+func (n *nodeResults) latency(op string) *metrics.LatencyHistogram {
+	h := metrics.NewLatencyHistogram()
+	fromSummaries := false
+	for _, s := range n.summaries {
+		if s.Op == op && s.Latency != nil {
+			h.Merge(s.Latency)
+			fromSummaries = true
+		}
+	}
+	if fromSummaries {
+		return h
+	}
+	for _, rec := range n.measuredOps(op) {
+		if rec.Error == "" {
+			h.Update(rec.End.Sub(rec.Start))
+		}
+	}
+	return h
+}
+
+// reportRow is one line of the report table.
+type reportRow struct {
+	name    string
+	count   int
+	errors  int
+	bytes   int64
+	start   time.Time
+	end     time.Time
+	latency *metrics.LatencyHistogram
+}
+
+func (r *reportRow) add(rec OpRecord) {
+	r.count++
+	if rec.Error != "" {
+		r.errors++
+	} else {
+		r.bytes += rec.Size
+	}
+	if r.start.IsZero() || rec.Start.Before(r.start) {
+		r.start = rec.Start
+	}
+	if rec.End.After(r.end) {
+		r.end = rec.End
+	}
+}
+
+func (r *reportRow) String() string {
+	d := r.end.Sub(r.start).Seconds()
+	mbps, opss := 0.0, 0.0
+	if d > 0 {
+		mbps = float64(r.bytes) / 1024 / 1024 / d
+		opss = float64(r.count-r.errors) / d
+	}
+	ps := r.latency.Percentiles([]float64{0.5, 0.9, 0.99, 0.999})
+	return fmt.Sprintf("%-24s %7d %6d %10.2f %8.2f %8.2f %10.2f %10.2f %10.2f %10.2f %10.2f %10.2f",
+		r.name, r.count, r.errors, float64(r.bytes)/1024/1024, mbps, opss,
+		r.latency.Mean()/metrics.MS, ps[0]/metrics.MS, ps[1]/metrics.MS, ps[2]/metrics.MS, ps[3]/metrics.MS, float64(r.latency.Max())/metrics.MS)
+}
+
+/*
+Report merges the result files of several nodes into one report, per kind of operation:
+
+  - a table with one row per node and a combined row, whose latency percentiles come from the merged HDR
+    histograms of all nodes (not from averaging per-node percentiles)
+  - the throughput of every node and of all nodes together, in intervals of wall-clock time since the earliest record
+
+Nodes are aligned by the absolute timestamps of their records, so their clocks should be synchronized (NTP). PeriodLog
+files of traceDownload only contribute to the throughput series, their percentiles cannot be merged.
+*/
+func Report(paths []string, interval time.Duration) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("no result files given, usage: xipfs -c report [-interval 10s] <file> [<file> ...]")
+	}
+	if interval <= 0 {
+		return fmt.Errorf("invalid interval %s", interval)
+	}
+	var nodes []*nodeResults
+	for _, p := range paths {
+		node, err := loadResults(p)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, node)
+	}
+
+	var origin, last time.Time
+	ops := make(map[string]bool)
+	see := func(start, end time.Time) {
+		if origin.IsZero() || start.Before(origin) {
+			origin = start
+		}
+		if end.After(last) {
+			last = end
+		}
+	}
+	for _, n := range nodes {
+		for _, rec := range n.ops {
+			ops[rec.Op] = true
+			see(rec.Start, rec.End)
+		}
+		for _, s := range n.periods {
+			see(s.end.Add(-time.Minute), s.end)
+		}
+	}
+	kinds := make([]string, 0, len(ops))
+	for op := range ops {
+		kinds = append(kinds, op)
+	}
+	sort.Strings(kinds)
+
+	fmt.Printf("report of %d nodes from %s to %s (%.1f s)\n", len(nodes), origin.Format(time.RFC3339), last.Format(time.RFC3339), last.Sub(origin).Seconds())
+	for _, op := range kinds {
+		fmt.Printf("\n-- %s\n", op)
+		fmt.Printf("%-24s %7s %6s %10s %8s %8s %10s %10s %10s %10s %10s %10s\n",
+			"node", "count", "errors", "MB", "MB/s", "ops/s", "mean(ms)", "p50(ms)", "p90(ms)", "p99(ms)", "p99.9(ms)", "max(ms)")
+		all := &reportRow{name: "all", latency: metrics.NewLatencyHistogram()}
+		for _, n := range nodes {
+			measured := n.measuredOps(op)
+			if len(measured) == 0 {
+				continue
+			}
+			row := &reportRow{name: n.name, latency: n.latency(op)}
+			for _, rec := range measured {
+				row.add(rec)
+				all.add(rec)
+			}
+			all.latency.Merge(row.latency)
+			fmt.Println(row)
+		}
+		fmt.Println(all)
+	}
+
+	printThroughputSeries(nodes, kinds, origin, last, interval)
+	return nil
+}
+
+// printThroughputSeries prints MB/s per interval, crediting every operation to the interval it completed in.
+func printThroughputSeries(nodes []*nodeResults, kinds []string, origin, last time.Time, interval time.Duration) {
+	if origin.IsZero() {
+		return
+	}
+	buckets := int(last.Sub(origin)/interval) + 1
+	series := make([][]float64, len(nodes))
+	for i, n := range nodes {
+		series[i] = make([]float64, buckets)
+		for _, op := range kinds {
+			for _, rec := range n.measuredOps(op) {
+				if rec.Error == "" {
+					series[i][int(rec.End.Sub(origin)/interval)] += float64(rec.Size) / 1024 / 1024
+				}
+			}
+		}
+		// a PeriodLog sample is the average over the minute before it, spread it over the intervals of that minute
+		for _, s := range n.periods {
+			for t := s.end.Add(-time.Minute); t.Before(s.end); t = t.Add(interval) {
+				b := int(t.Sub(origin) / interval)
+				step := interval
+				if rest := s.end.Sub(t); rest < step {
+					step = rest
+				}
+				if b >= 0 && b < buckets {
+					series[i][b] += s.mbps * step.Seconds()
+				}
+			}
+		}
+	}
+
+	fmt.Printf("\n-- throughput (MB/s per %s)\n%-10s", interval, "t(s)")
+	for _, n := range nodes {
+		fmt.Printf(" %12.12s", n.name)
+	}
+	fmt.Printf(" %12s\n", "all")
+	for b := 0; b < buckets; b++ {
+		fmt.Printf("%-10.0f", (time.Duration(b) * interval).Seconds())
+		total := 0.0
+		for i := range nodes {
+			v := series[i][b] / interval.Seconds()
+			total += v
+			fmt.Printf(" %12.2f", v)
+		}
+		fmt.Printf(" %12.2f\n", total)
+	}
+}
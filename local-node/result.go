@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"metrics"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	icore "github.com/ipfs/interface-go-ipfs-core"
+	icorepath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// OpRecord is the machine-readable result of one operation: an upload, a file get or a provider lookup. Arrival is
+// only set by open-loop runs, QueueMs is then the time from arrival to Start, apart from LatencyMs. Only records of
+// the steady phase are accounted into summaries. Config names the configuration of a sweep that ran the operation.
+type OpRecord struct {
+	Record    string    `json:"record"`
+	Command   string    `json:"command"`
+	Op        string    `json:"op"`
+	Worker    int       `json:"worker"`
+	CID       string    `json:"cid"`
+	Size      int64     `json:"size"`
+	Arrival   time.Time `json:"-"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	QueueMs   float64   `json:"queue_ms"`
+	LatencyMs float64   `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+	Providers int       `json:"providers"`
+	Peers     int       `json:"peers"`
+	Phase     string    `json:"phase"`
+	Verify    string    `json:"verify,omitempty"`
+	Config    string    `json:"config,omitempty"`
+	// set by range reads and, TTFBMs to LastBlockMs, by gets
+	Offset        int64   `json:"offset,omitempty"`
+	TTFBMs        float64 `json:"ttfb_ms,omitempty"`
+	RootMs        float64 `json:"root_ms,omitempty"`
+	LastBlockMs   float64 `json:"last_block_ms,omitempty"`
+	NeededBlocks  int     `json:"needed_blocks,omitempty"`
+	FetchedBlocks int     `json:"fetched_blocks,omitempty"`
+	OverFetched   int     `json:"over_fetched,omitempty"`
+}
+
+// SummaryRecord aggregates all OpRecords of one kind of operation emitted during a command.
+type SummaryRecord struct {
+	Record         string    `json:"record"`
+	Command        string    `json:"command"`
+	Op             string    `json:"op"`
+	Count          int       `json:"count"`
+	Errors         int       `json:"errors"`
+	Bytes          int64     `json:"bytes"`
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	DurationSec    float64   `json:"duration_s"`
+	ThroughputMBps float64   `json:"throughput_mbps"`
+	OpsPerSec      float64   `json:"ops_per_s"`
+	MeanMs         float64   `json:"mean_ms"`
+	P50Ms          float64   `json:"p50_ms"`
+	P90Ms          float64   `json:"p90_ms"`
+	P99Ms          float64   `json:"p99_ms"`
+	P999Ms         float64   `json:"p999_ms"`
+	MaxMs          float64   `json:"max_ms"`
+	QueueMeanMs    float64   `json:"queue_mean_ms"`
+	QueueP99Ms     float64   `json:"queue_p99_ms"`
+	VerifyFailures int       `json:"verify_failures"`
+	Config         string    `json:"config,omitempty"`
+	// Latency holds every latency of the summary, so summaries of several workers or nodes can be merged.
+	Latency *metrics.LatencyHistogram `json:"latency_hdr"`
+}
+
+type opSummary struct {
+	op        string
+	count     int
+	errors    int
+	verifyErr int
+	config    string
+	bytes     int64
+	start     time.Time
+	end       time.Time
+	latencies *metrics.LatencyHistogram
+	queueing  *metrics.LatencyHistogram
+}
+
+// ResultWriter emits OpRecords as they complete and a SummaryRecord per operation kind, formatted as JSON lines
+// or CSV. The "text" format writes nothing, leaving the human-readable log lines of each command as the output.
+type ResultWriter struct {
+	command string
+	format  string
+
+	lock      sync.Mutex
+	out       io.Writer
+	file      *os.File
+	csv       *csv.Writer
+	columns   []string
+	summaries map[string]*opSummary
+}
+
+var results = &ResultWriter{format: "text"}
+
+// timeline receives the per-block timeline of every get if -timeline is set, chromeTrace its events if -chrometrace is
+// and lookupTrees its DHT lookups if -lookuptree is.
+var timeline *metrics.TimelineWriter
+var chromeTrace *metrics.ChromeTraceWriter
+var lookupTrees *metrics.LookupTreeWriter
+
+// NewResultWriter creates a writer of the given format ("text", "json" or "csv"), writing to path or stdout if
+// path is empty.
+func NewResultWriter(command, format, path string) (*ResultWriter, error) {
+	rw := &ResultWriter{
+		command:   command,
+		format:    format,
+		out:       os.Stdout,
+		summaries: make(map[string]*opSummary),
+	}
+	switch format {
+	case "text":
+		return rw, nil
+	case "json", "csv":
+	default:
+		return nil, fmt.Errorf("unknown result format %q, expected json, csv or text", format)
+	}
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create result file %s: %s", path, err)
+		}
+		rw.file = f
+		rw.out = f
+	}
+	if format == "csv" {
+		rw.csv = csv.NewWriter(rw.out)
+		rw.columns = unionColumns(OpRecord{}, SummaryRecord{})
+	}
+	return rw, nil
+}
+
+// Spec records the configuration of the run ahead of any result.
+func (rw *ResultWriter) Spec(spec *ExperimentSpec) {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	switch rw.format {
+	case "json":
+		rw.writeJSON(struct {
+			Record string          `json:"record"`
+			Spec   *ExperimentSpec `json:"spec"`
+		}{"spec", spec})
+	case "csv":
+		fmt.Fprintf(rw.out, "# spec: %s\n", spec)
+		rw.csv.Write(rw.columns)
+		rw.csv.Flush()
+	}
+}
+
+// Op emits the record of one finished operation and accounts it into the summary of its kind.
+func (rw *ResultWriter) Op(rec OpRecord) {
+	rec.Record = "op"
+	rec.Command = rw.command
+	if rec.End.IsZero() {
+		rec.End = time.Now()
+	}
+	rec.LatencyMs = rec.End.Sub(rec.Start).Seconds() * 1000
+	if !rec.Arrival.IsZero() {
+		rec.QueueMs = rec.Start.Sub(rec.Arrival).Seconds() * 1000
+	}
+	rec.Phase = phases.Phase(rec.Start)
+
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	if rw.format == "text" {
+		return
+	}
+	if rec.Phase != PhaseSteady {
+		rw.write(rec)
+		return
+	}
+	// operations of one kind run under several configurations at once, e.g. -scheduler, are summarized apart
+	key := rec.Op + "\x00" + rec.Config
+	s, ok := rw.summaries[key]
+	if !ok {
+		s = &opSummary{
+			op:        rec.Op,
+			config:    rec.Config,
+			start:     rec.Start,
+			latencies: metrics.NewLatencyHistogram(),
+			queueing:  metrics.NewLatencyHistogram(),
+		}
+		rw.summaries[key] = s
+	}
+	first := rec.Start
+	if !rec.Arrival.IsZero() {
+		first = rec.Arrival
+		s.queueing.Update(rec.Start.Sub(rec.Arrival))
+	}
+	if first.Before(s.start) {
+		s.start = first
+	}
+	if rec.End.After(s.end) {
+		s.end = rec.End
+	}
+	s.count++
+	if rec.Verify == VerifyFailed {
+		s.verifyErr++
+	}
+	if rec.Error != "" {
+		s.errors++
+	} else {
+		s.bytes += rec.Size
+		s.latencies.Update(rec.End.Sub(rec.Start))
+	}
+	rw.write(rec)
+}
+
+// Summary emits a SummaryRecord for every kind of operation and configuration seen since the last call.
+func (rw *ResultWriter) Summary() {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	if rw.format == "text" {
+		return
+	}
+	keys := make([]string, 0, len(rw.summaries))
+	for key := range rw.summaries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := rw.summaries[key]
+		l := s.latencies
+		ps := l.Percentiles([]float64{0.5, 0.9, 0.99, 0.999})
+		rec := SummaryRecord{
+			Record:      "summary",
+			Command:     rw.command,
+			Op:          s.op,
+			Count:       s.count,
+			Errors:      s.errors,
+			Bytes:       s.bytes,
+			Start:       s.start,
+			End:         s.end,
+			DurationSec: s.end.Sub(s.start).Seconds(),
+			MeanMs:      l.Mean() / metrics.MS,
+			P50Ms:       ps[0] / metrics.MS,
+			P90Ms:       ps[1] / metrics.MS,
+			P99Ms:       ps[2] / metrics.MS,
+			P999Ms:      ps[3] / metrics.MS,
+			MaxMs:       float64(l.Max()) / metrics.MS,
+			QueueMeanMs: s.queueing.Mean() / metrics.MS,
+			QueueP99Ms:  s.queueing.Percentile(0.99) / metrics.MS,
+			Latency:     l,
+		}
+		rec.VerifyFailures = s.verifyErr
+		rec.Config = s.config
+		if rec.DurationSec > 0 {
+			rec.ThroughputMBps = float64(s.bytes) / 1024 / 1024 / rec.DurationSec
+			rec.OpsPerSec = float64(s.count-s.errors) / rec.DurationSec
+		}
+		rw.write(rec)
+	}
+	rw.summaries = make(map[string]*opSummary)
+}
+
+// Close flushes pending records and closes the result file.
+func (rw *ResultWriter) Close() {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	if rw.csv != nil {
+		rw.csv.Flush()
+	}
+	if rw.file != nil {
+		rw.file.Close()
+		rw.file = nil
+	}
+}
+
+func (rw *ResultWriter) write(rec interface{}) {
+	switch rw.format {
+	case "json":
+		rw.writeJSON(rec)
+	case "csv":
+		rw.csv.Write(csvRow(rw.columns, rec))
+		rw.csv.Flush()
+	}
+}
+
+func (rw *ResultWriter) writeJSON(rec interface{}) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		fmt.Printf("failed to marshal result: %s\n", err.Error())
+		return
+	}
+	rw.out.Write(append(data, '\n'))
+}
+
+// unionColumns returns the json names of all fields of the given records, in declaration order and without
+// duplicates, so that all record kinds share one CSV header.
+func unionColumns(recs ...interface{}) []string {
+	var columns []string
+	for _, rec := range recs {
+		t := reflect.TypeOf(rec)
+		for i := 0; i < t.NumField(); i++ {
+			name := jsonName(t.Field(i))
+			if name != "-" && !containsString(columns, name) {
+				columns = append(columns, name)
+			}
+		}
+	}
+	return columns
+}
+
+func csvRow(columns []string, rec interface{}) []string {
+	v := reflect.ValueOf(rec)
+	t := v.Type()
+	byName := make(map[string]string, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		byName[jsonName(t.Field(i))] = csvValue(v.Field(i).Interface())
+	}
+	row := make([]string, len(columns))
+	for i, c := range columns {
+		row[i] = byName[c]
+	}
+	return row
+}
+
+// csvFill is the inverse of csvRow: it sets the fields of the struct rec points to from a row read back.
+func csvFill(columns []string, row []string, rec interface{}) error {
+	v := reflect.ValueOf(rec).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := jsonName(t.Field(i))
+		value := csvField(columns, row, name)
+		if name == "-" || value == "" {
+			continue
+		}
+		f := v.Field(i)
+		var err error
+		switch f.Interface().(type) {
+		case string:
+			f.SetString(value)
+		case int, int64:
+			var n int64
+			n, err = strconv.ParseInt(value, 10, 64)
+			f.SetInt(n)
+		case float64:
+			var x float64
+			x, err = strconv.ParseFloat(value, 64)
+			f.SetFloat(x)
+		case time.Time:
+			var ts time.Time
+			ts, err = time.Parse(time.RFC3339Nano, value)
+			f.Set(reflect.ValueOf(ts))
+		case json.Unmarshaler:
+			p := reflect.New(f.Type().Elem())
+			err = p.Interface().(json.Unmarshaler).UnmarshalJSON([]byte(value))
+			f.Set(p)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %s", name, value, err)
+		}
+	}
+	return nil
+}
+
+func csvField(columns []string, row []string, name string) string {
+	for i, c := range columns {
+		if c == name && i < len(row) {
+			return row[i]
+		}
+	}
+	return ""
+}
+
+func csvValue(v interface{}) string {
+	switch t := v.(type) {
+	case time.Time:
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(t, 'f', 3, 64)
+	case json.Marshaler:
+		if reflect.ValueOf(t).IsNil() {
+			return ""
+		}
+		data, err := t.MarshalJSON()
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+	return fmt.Sprint(v)
+}
+
+func jsonName(f reflect.StructField) string {
+	return strings.Split(f.Tag.Get("json"), ",")[0]
+}
+
+// withTimeline adds the time to the first byte (first, zero if unknown), to the root block and to the last block to the
+// record of a get, and writes the timeline, the trace events and the DHT lookup trees of its blocks from the monitors
+// of col. It has to run before col is collected, and leaves them out if col overlapped with another operation.
+func withTimeline(rec OpRecord, col *metrics.Collector, first time.Time) OpRecord {
+	ttfb := time.Duration(0)
+	if !first.IsZero() {
+		ttfb = first.Sub(rec.Start)
+		rec.TTFBMs = ttfb.Seconds() * 1000
+	}
+	// the events of an operation that overlapped with another one are mixed with those of the other
+	if metrics.CMD_EnableMetrics && !col.Overlapped() {
+		rec.RootMs = col.Monitor.TimeToRoot().Seconds() * 1000
+		rec.LastBlockMs = col.Monitor.TimeToLastBlock().Seconds() * 1000
+		if err := timeline.Write(col.Monitor, rec.CID, ttfb, rec.End.Sub(rec.Start)); err != nil {
+			fmt.Printf("failed to write the timeline of %s: %s\n", rec.CID, err.Error())
+		}
+		if err := chromeTrace.Write(col.Monitor, col.FP, rec.CID); err != nil {
+			fmt.Printf("failed to write the trace of %s: %s\n", rec.CID, err.Error())
+		}
+		if err := lookupTrees.Write(col.FP, rec.CID); err != nil {
+			fmt.Printf("failed to write the lookup trees of %s: %s\n", rec.CID, err.Error())
+		}
+	}
+	return rec
+}
+
+// connectedPeers returns the number of peers the node is currently connected to.
+func connectedPeers(ctx context.Context, ipfs icore.CoreAPI) int {
+	peers, err := ipfs.Swarm().Peers(ctx)
+	if err != nil {
+		return 0
+	}
+	return len(peers)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func cidString(p icorepath.Resolved) string {
+	if p == nil {
+		return ""
+	}
+	return p.Cid().String()
+}
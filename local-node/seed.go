@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"time"
+)
+
+/*
+workloadSeed drives every random choice of a run: file content, the order of randomized requests, arrival times and
+emulated network conditions. Each of them draws from its own stream, derived from the seed, a stream name and an
+index, so content depends only on which file it is, not on how uploads interleave:
+
+	content:  file i of upload, uploadqps and traceUpload
+	dup:      the shared blocks of -content dup
+	backend:  the i-th file generated by ipfsbackend
+	block:    block i of the fullnode
+	shuffle:  the request order of traceDownload -randomRequest
+	arrival:  poisson arrivals
+	netem:    drawn loss rates of the matrix and the jitter and loss of every proxy
+
+Two runs with the same -seed upload byte-identical files, i.e. identical CIDs, and issue requests in the same order on
+every machine. Without -seed a seed is drawn from the clock and the MAC addresses, as Shuffle always did, and recorded in
+the spec of the run so it can be repeated.
+*/
+var workloadSeed int64
+
+// SetSeed sets the seed of the run, 0 draws a new one. It returns the seed in use.
+func SetSeed(seed int64) int64 {
+	if seed == 0 {
+		seed = time.Now().UnixNano() + macSeed()
+	}
+	workloadSeed = seed
+	return seed
+}
+
+// seededRand returns the random stream i of the given name.
+func seededRand(stream string, i int) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(stream))
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(workloadSeed))
+	binary.BigEndian.PutUint64(buf[8:], uint64(i))
+	h.Write(buf[:])
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// macSeed sums the MAC addresses of this host, so hosts started at the same time still draw different seeds.
+func macSeed() int64 {
+	interfaces, _ := net.Interfaces()
+	mac := int64(0)
+	for _, i := range interfaces {
+		if ha := i.HardwareAddr; len(ha) > 0 {
+			ha = append(ha, 8)
+			ha = append(ha, 9)
+			mac += BytesToInt64(ha)
+		}
+	}
+	return mac
+}
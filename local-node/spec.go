@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ExperimentSpec describes a whole xipfs run in one file: the command to execute and the values of
+// its flags, grouped by purpose. Keys inside each section are exactly the command-line flag names, so a
+// spec can always be translated back into a flag string and vice versa.
+//
+//	command: downloads
+//	workload:
+//	  cid: cid
+//	  cg: 4
+//	features:
+//	  enablepbitswap: true
+//	  PeerRH: true
+//	output:
+//	  enablemetrics: true
+type ExperimentSpec struct {
+	Command  string                 `json:"command" yaml:"command"`
+	Workload map[string]interface{} `json:"workload,omitempty" yaml:"workload,omitempty"`
+	Features map[string]interface{} `json:"features,omitempty" yaml:"features,omitempty"`
+	Output   map[string]interface{} `json:"output,omitempty" yaml:"output,omitempty"`
+}
+
+// specSections lists, for each section of a spec, the flags it is allowed to set.
+var specSections = []struct {
+	name string
+	keys []string
+}{
+	{"workload", []string{"s", "n", "p", "qps", "cg", "chunker", "redun", "content", "regenerate", "f", "i", "servers", "randomRequest", "dn", "spn", "rmn", "bc", "ipfs", "nodes", "tnw", "netem", "arrival", "rate", "warmup", "duration", "seed", "fanout", "depth", "sizedist", "dirpath", "chunkers", "layouts", "rawleaves", "sweepfiles", "rangedist", "rangesize", "ranges"}},
+	{"features", []string{"enablepbitswap", "discoworker", "pbticker", "scheduler", "pbbalance", "pbendgame", "pbcontroller", "PeerRH", "B", "earlyabort", "eac", "fastsync", "pw", "qpt", "nna",
+		"providefirst", "provideeach", "closebackprovide", "closelan", "closedhtrefresh", "blocksizelimit", "pag", "stallafterupload", "sad", "verify", "manifest", "sink", "sharding"}},
+	{"output", []string{"cid", "enablemetrics", "seelogs", "out", "outfile", "timeline", "chrometrace", "lookuptree", "batchlog", "metricsaddr", "interval"}},
+}
+
+var knownCommands = []string{"upload", "downloads", "findproviderqps", "uploadqps", "daemon", "traceUpload", "traceDownload", "ipfsbackend", "fullnode", "lightnode", "testnet", "report", "uploaddir", "chunksweep", "rangedownload"}
+
+func (s *ExperimentSpec) section(name string) map[string]interface{} {
+	switch name {
+	case "workload":
+		return s.Workload
+	case "features":
+		return s.Features
+	case "output":
+		return s.Output
+	}
+	return nil
+}
+
+func (s *ExperimentSpec) setSection(name string, values map[string]interface{}) {
+	switch name {
+	case "workload":
+		s.Workload = values
+	case "features":
+		s.Features = values
+	case "output":
+		s.Output = values
+	}
+}
+
+// loadSpec reads an experiment spec from a YAML or JSON (by ".json" extension) file, rejecting unknown keys and
+// values that do not fit the type of their flag.
+func loadSpec(path string) (*ExperimentSpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spec %s: %s", path, err)
+	}
+
+	var spec ExperimentSpec
+	if strings.HasSuffix(path, ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&spec)
+	} else {
+		err = yaml.UnmarshalStrict(data, &spec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse spec %s: %s", path, err)
+	}
+
+	if errs := spec.validate(); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid spec %s:\n    %s", path, strings.Join(errs, "\n    "))
+	}
+	return &spec, nil
+}
+
+// validate checks every key and value of the spec against the registered flags and returns all problems found.
+func (s *ExperimentSpec) validate() []string {
+	var errs []string
+	if s.Command != "" && !containsString(knownCommands, s.Command) {
+		errs = append(errs, fmt.Sprintf("unknown command %q, expected one of: %s", s.Command, strings.Join(knownCommands, ", ")))
+	}
+	for _, sec := range specSections {
+		values := s.section(sec.name)
+		for _, key := range sortedKeys(values) {
+			if !containsString(sec.keys, key) {
+				errs = append(errs, fmt.Sprintf("unknown key %q in section %s, expected one of: %s", key, sec.name, strings.Join(sec.keys, ", ")))
+				continue
+			}
+			f := flag.Lookup(key)
+			if f == nil {
+				errs = append(errs, fmt.Sprintf("key %q in section %s has no matching flag", key, sec.name))
+				continue
+			}
+			if err := checkFlagValue(f, specValueString(values[key])); err != nil {
+				errs = append(errs, fmt.Sprintf("%s.%s: %s", sec.name, key, err))
+			}
+		}
+	}
+	return errs
+}
+
+// apply sets the flags described by the spec. Flags given explicitly on the command line take precedence.
+func (s *ExperimentSpec) apply() error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if s.Command != "" && !explicit["c"] {
+		if err := flag.Set("c", s.Command); err != nil {
+			return err
+		}
+	}
+	for _, sec := range specSections {
+		values := s.section(sec.name)
+		for _, key := range sortedKeys(values) {
+			if explicit[key] {
+				fmt.Printf("spec: %s.%s overridden by command line\n", sec.name, key)
+				continue
+			}
+			if err := flag.Set(key, specValueString(values[key])); err != nil {
+				return fmt.Errorf("%s.%s: %s", sec.name, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// effectiveSpec captures the values of every flag covered by a spec section as they are after parsing, so the
+// output of a run records exactly how it was configured.
+func effectiveSpec() *ExperimentSpec {
+	spec := &ExperimentSpec{}
+	if f := flag.Lookup("c"); f != nil {
+		spec.Command = f.Value.String()
+	}
+	for _, sec := range specSections {
+		values := make(map[string]interface{})
+		for _, key := range sec.keys {
+			if f := flag.Lookup(key); f != nil {
+				if g, ok := f.Value.(flag.Getter); ok {
+					values[key] = g.Get()
+					if d, ok := values[key].(time.Duration); ok {
+						// keep durations readable and parseable, not nanoseconds
+						values[key] = d.String()
+					}
+				} else {
+					values[key] = f.Value.String()
+				}
+			}
+		}
+		spec.setSection(sec.name, values)
+	}
+	return spec
+}
+
+func (s *ExperimentSpec) String() string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+func checkFlagValue(f *flag.Flag, v string) error {
+	g, ok := f.Value.(flag.Getter)
+	if !ok {
+		return nil
+	}
+	var err error
+	switch g.Get().(type) {
+	case bool:
+		_, err = strconv.ParseBool(v)
+	case int:
+		_, err = strconv.ParseInt(v, 0, strconv.IntSize)
+	case float64:
+		_, err = strconv.ParseFloat(v, 64)
+	case time.Duration:
+		_, err = time.ParseDuration(v)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q for flag -%s", v, f.Name)
+	}
+	return nil
+}
+
+func specValueString(v interface{}) string {
+	switch t := v.(type) {
+	case float64:
+		// JSON decodes every number as float64, print integers without exponent
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
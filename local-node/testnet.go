@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	config "github.com/ipfs/go-ipfs-config"
+	icore "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// TestnetNode is one ephemeral node of an in-process testnet.
+type TestnetNode struct {
+	API   icore.CoreAPI
+	ID    peer.ID
+	Addrs []multiaddr.Multiaddr
+	repo  string
+}
+
+// Testnet is a set of ephemeral nodes living in this process, listening on loopback only and forming a private
+// DHT among themselves: no bootstrap peers and no MDNS, so they never reach the public network.
+type Testnet struct {
+	Nodes []*TestnetNode
+
+	netem   *NetemMatrix
+	proxies map[[2]int]*NetemProxy // the emulated link of every pair, keyed by the higher index first
+}
+
+// netemNodes is the loopback network the nodes of a testnet with netem listen in, 127.0.0.1 is left to the proxies.
+const netemNodes = "127.0.1.0/24"
+
+// testnetConfig restricts a default config to loopback, without any way of discovering peers outside the testnet.
+func testnetConfig(cfg *config.Config) {
+	cfg.Bootstrap = []string{}
+	cfg.Addresses.Swarm = []string{"/ip4/127.0.0.1/tcp/0"}
+	cfg.Addresses.Announce = []string{}
+	cfg.Addresses.API = config.Strings{}
+	cfg.Addresses.Gateway = config.Strings{}
+	cfg.Discovery.MDNS.Enabled = false
+	cfg.Swarm.DisableNatPortMap = true
+	cfg.Routing.Type = "dht"
+}
+
+/*
+netemConfig is testnetConfig for node i of a testnet with netem. The node listens on an address of its own in
+netemNodes, which every node filters: it neither announces nor dials these addresses, and it refuses connections coming
+from them. The proxies dial from 127.0.0.1, so the emulated links are the only way between two nodes, also when a node
+redials a peer it learned from identify or the DHT.
+*/
+func netemConfig(i int) func(*config.Config) {
+	filter := "/ip4/127.0.1.0/ipcidr/24"
+	return func(cfg *config.Config) {
+		testnetConfig(cfg)
+		cfg.Addresses.Swarm = []string{fmt.Sprintf("/ip4/127.0.1.%d/tcp/0", i+1)}
+		cfg.Addresses.NoAnnounce = []string{filter}
+		cfg.Swarm.AddrFilters = []string{filter}
+	}
+}
+
+// StartTestnet spawns n ephemeral nodes and connects every pair of them, through emulated links if netem is not nil.
+// The nodes live until the returned context is canceled, Close removes their repos afterwards.
+func StartTestnet(n int, netem *NetemMatrix) (context.Context, *Testnet, context.CancelFunc, error) {
+	fmt.Printf("-- Getting an in-process testnet of %d nodes running -- \n", n)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := setupPlugins(""); err != nil {
+		cancel()
+		return nil, nil, nil, err
+	}
+
+	if netem != nil && n > 254 {
+		cancel()
+		return nil, nil, nil, fmt.Errorf("a testnet with netem has at most 254 nodes, one per address of %s", netemNodes)
+	}
+	tn := &Testnet{netem: netem, proxies: make(map[[2]int]*NetemProxy)}
+	for i := 0; i < n; i++ {
+		configure := testnetConfig
+		if netem != nil {
+			configure = netemConfig(i)
+		}
+		repoPath, err := createTempRepo(ctx, configure)
+		if err != nil {
+			tn.Close()
+			cancel()
+			return nil, nil, nil, fmt.Errorf("failed to create repo for node %d: %s", i, err)
+		}
+		node := &TestnetNode{repo: repoPath}
+		tn.Nodes = append(tn.Nodes, node)
+
+		node.API, err = createNode(ctx, repoPath)
+		if err != nil {
+			tn.Close()
+			cancel()
+			return nil, nil, nil, fmt.Errorf("failed to spawn node %d: %s", i, err)
+		}
+		self, err := node.API.Key().Self(ctx)
+		if err != nil {
+			tn.Close()
+			cancel()
+			return nil, nil, nil, err
+		}
+		node.ID = self.ID()
+		node.Addrs, err = node.API.Swarm().ListenAddrs(ctx)
+		if err != nil {
+			tn.Close()
+			cancel()
+			return nil, nil, nil, err
+		}
+		if netem != nil {
+			fmt.Printf("node-%d %s %v region %s\n", i, node.ID, node.Addrs, netem.Region(i))
+		} else {
+			fmt.Printf("node-%d %s %v\n", i, node.ID, node.Addrs)
+		}
+	}
+
+	if err := tn.connectAll(ctx); err != nil {
+		tn.Close()
+		cancel()
+		return nil, nil, nil, err
+	}
+	if err := tn.CheckNetem(ctx); err != nil {
+		tn.Close()
+		cancel()
+		return nil, nil, nil, err
+	}
+	fmt.Println("Testnet is running")
+	return ctx, tn, cancel, nil
+}
+
+// connectAll connects every pair of nodes, so that all of them start with a full routing table.
+func (tn *Testnet) connectAll(ctx context.Context) error {
+	for i, from := range tn.Nodes {
+		for j := 0; j < i; j++ {
+			to := tn.Nodes[j]
+			addrs := to.Addrs
+			if tn.netem != nil {
+				proxied, err := tn.proxy(i, j)
+				if err != nil {
+					return err
+				}
+				addrs = []multiaddr.Multiaddr{proxied}
+			}
+			if err := from.API.Swarm().Connect(ctx, peer.AddrInfo{ID: to.ID, Addrs: addrs}); err != nil {
+				return fmt.Errorf("failed to connect node-%d to node-%d: %s", i, j, err)
+			}
+		}
+	}
+	return nil
+}
+
+// proxy starts the emulated link from node i to node j and returns the address node i has to dial. It is the only
+// address of node j that node i can reach, see netemConfig.
+func (tn *Testnet) proxy(i, j int) (multiaddr.Multiaddr, error) {
+	target, err := tcpTarget(tn.Nodes[j].Addrs)
+	if err != nil {
+		return nil, err
+	}
+	link := tn.netem.Link(i, j)
+	p, err := StartNetemProxy(target, link, seededRand("netem", 1+i*len(tn.Nodes)+j))
+	if err != nil {
+		return nil, fmt.Errorf("failed to start netem proxy node-%d -> node-%d: %s", i, j, err)
+	}
+	tn.proxies[[2]int{i, j}] = p
+	fmt.Printf("netem node-%d <-> node-%d: %s\n", i, j, link)
+	return p.Multiaddr()
+}
+
+// Providers are all nodes but the last one, they add the content the client fetches.
+func (tn *Testnet) Providers() []*TestnetNode {
+	return tn.Nodes[:len(tn.Nodes)-1]
+}
+
+// Client is the last node, it runs the measured workload.
+func (tn *Testnet) Client() *TestnetNode {
+	return tn.Nodes[len(tn.Nodes)-1]
+}
+
+/*
+CheckNetem fails if a connection between two testnet nodes does not go through the emulated link of its pair. The
+address filters of netemConfig keep nodes from dialing each other directly, but a node can still learn the proxy of
+another pair from the DHT, and the conditions of that pair would apply instead. Commands call it once the workload is
+done, a run that fails it did not measure the links of the matrix.
+*/
+func (tn *Testnet) CheckNetem(ctx context.Context) error {
+	if tn.netem == nil {
+		return nil
+	}
+	index := make(map[peer.ID]int)
+	for i, n := range tn.Nodes {
+		index[n.ID] = i
+	}
+	bypassed := 0
+	for i, n := range tn.Nodes {
+		conns, err := n.API.Swarm().Peers(ctx)
+		if err != nil {
+			return fmt.Errorf("netem: failed to list the connections of node-%d: %s", i, err)
+		}
+		for _, c := range conns {
+			j, ok := index[c.ID()]
+			if !ok {
+				continue
+			}
+			addr, err := tcpTarget([]multiaddr.Multiaddr{c.Address()})
+			if err == nil && tn.emulated(i, j, addr) {
+				continue
+			}
+			bypassed++
+			fmt.Printf("netem: node-%d is connected to node-%d at %s, bypassing their emulated link\n", i, j, c.Address())
+		}
+	}
+	if bypassed > 0 {
+		return fmt.Errorf("netem: %d connections bypass the emulated links, the conditions of their pairs were not emulated", bypassed)
+	}
+	return nil
+}
+
+// emulated reports whether a connection between nodes i and j at addr (host:port, as node i sees it) goes through the
+// proxy of their pair.
+func (tn *Testnet) emulated(i, j int, addr string) bool {
+	if i < j {
+		i, j = j, i
+	}
+	p, ok := tn.proxies[[2]int{i, j}]
+	return ok && p.Forwards(addr)
+}
+
+// Close stops the emulated links and removes the repos of all nodes, the nodes themselves stop with the context of
+// the testnet.
+func (tn *Testnet) Close() {
+	for _, p := range tn.proxies {
+		p.Close()
+	}
+	for _, n := range tn.Nodes {
+		os.RemoveAll(n.repo)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	icore "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	icorepath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+const (
+	VerifyOK     = "ok"
+	VerifyFailed = "failed"
+)
+
+/*
+Verifier checks that a downloaded file is the content that was uploaded, after it was written to disk:
+
+	cid:    re-import the written file with the upload chunker without storing it (hash only) and compare the root CID
+	sha256: compare the SHA-256 of the written file with the sidecar manifest written at upload time
+
+A nil Verifier verifies nothing.
+*/
+type Verifier struct {
+	mode         string
+	chunker      string
+	manifestPath string
+
+	lock     sync.Mutex
+	manifest map[string]string
+	failures int
+}
+
+var verifier *Verifier
+
+// NewVerifier returns nil if mode is empty. The sha256 mode reads the manifest written by an earlier upload, if
+// there is none yet the manifest is only written.
+func NewVerifier(mode, chunker, manifestPath string, s *Sink) (*Verifier, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case "cid":
+		if !s.OnDisk() {
+			return nil, fmt.Errorf("-verify cid re-imports the written file and needs -sink disk")
+		}
+	case "sha256":
+		if s.Mode == "discard" {
+			return nil, fmt.Errorf("-verify sha256 needs -sink disk or hash")
+		}
+	default:
+		return nil, fmt.Errorf("unknown verify mode %q, expected cid or sha256", mode)
+	}
+	v := &Verifier{mode: mode, chunker: chunker, manifestPath: manifestPath, manifest: make(map[string]string)}
+	if mode == "sha256" {
+		if err := v.loadManifest(manifestPath); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+func (v *Verifier) loadManifest(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			v.manifest[fields[0]] = fields[1]
+		}
+	}
+	return scanner.Err()
+}
+
+// Verify checks the content fetched for cid and returns VerifyOK or VerifyFailed, or "" if verification is off. The
+// content is the file at path, or, for the sha256 mode, sum if the content was hashed instead of written.
+func (v *Verifier) Verify(ctx context.Context, ipfs icore.CoreAPI, cid string, path string, sum string) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	var err error
+	switch v.mode {
+	case "cid":
+		err = v.verifyCid(ctx, ipfs, cid, path)
+	case "sha256":
+		err = v.verifySha256(cid, path, sum)
+	}
+	if err != nil {
+		v.lock.Lock()
+		v.failures++
+		v.lock.Unlock()
+		return VerifyFailed, fmt.Errorf("verification of %s failed: %s", cid, err)
+	}
+	return VerifyOK, nil
+}
+
+func (v *Verifier) verifyCid(ctx context.Context, ipfs icore.CoreAPI, cid string, path string) error {
+	node, err := getUnixfsNode(path)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+	p, err := ipfs.Unixfs().Add(ctx, node, options.Unixfs.Chunker(v.chunker), options.Unixfs.HashOnly(true), options.Unixfs.Pin(false))
+	if err != nil {
+		return err
+	}
+	want := cid
+	if strings.Contains(cid, "/") {
+		// a path in a directory tree, compare with the CID it resolves to
+		resolved, err := ipfs.ResolvePath(ctx, icorepath.New(cid))
+		if err != nil {
+			return err
+		}
+		want = resolved.Cid().String()
+	}
+	if p.Cid().String() != want {
+		return fmt.Errorf("written content re-imports to %s", p.Cid())
+	}
+	return nil
+}
+
+func (v *Verifier) verifySha256(cid string, path string, sum string) error {
+	v.lock.Lock()
+	want, ok := v.manifest[cid]
+	if !ok && v.manifestPath != "" {
+		// long-running nodes (ipfsbackend, lightnode) fetch content uploaded after they started
+		if err := v.loadManifest(v.manifestPath); err == nil {
+			want, ok = v.manifest[cid]
+		}
+	}
+	v.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("no manifest entry")
+	}
+	got := sum
+	if got == "" {
+		var err error
+		if got, err = sha256File(path); err != nil {
+			return err
+		}
+	}
+	if got != want {
+		return fmt.Errorf("sha256 %s, expected %s", got, want)
+	}
+	return nil
+}
+
+// Failures returns the number of failed verifications so far.
+func (v *Verifier) Failures() int {
+	if v == nil {
+		return 0
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.failures
+}
+
+// sha256File hashes the file at path. A directory hashes as all of its files concatenated in walk order, which is what
+// the hash Sink computes for a directory.
+func sha256File(path string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(path, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		f, err := os.Open(fpath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ManifestWriter appends "<cid> <sha256>" lines for uploaded content, read back by the sha256 Verifier.
+type ManifestWriter struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// NewManifestWriter returns nil unless the sha256 verify mode is used. It appends to the manifest, which an
+// ipfsbackend reads and writes at once; an entry of the same cid read later wins.
+func NewManifestWriter(mode, path string) (*ManifestWriter, error) {
+	if mode != "sha256" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create manifest %s: %s", path, err)
+	}
+	return &ManifestWriter{file: f}, nil
+}
+
+// Add records the hash of data, uploaded as cid.
+func (m *ManifestWriter) Add(cid string, data []byte) {
+	if m == nil {
+		return
+	}
+	sum := sha256.Sum256(data)
+	m.write(cid, hex.EncodeToString(sum[:]))
+}
+
+// AddFile records the hash of the file at path, uploaded as cid.
+func (m *ManifestWriter) AddFile(cid string, path string) {
+	if m == nil {
+		return
+	}
+	sum, err := sha256File(path)
+	if err != nil {
+		fmt.Printf("failed to hash %s for the manifest: %s\n", path, err.Error())
+		return
+	}
+	m.write(cid, sum)
+}
+
+func (m *ManifestWriter) write(cid, sum string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	fmt.Fprintf(m.file, "%s %s\n", cid, sum)
+}
+
+func (m *ManifestWriter) Close() {
+	if m == nil {
+		return
+	}
+	m.file.Close()
+}
+
+var manifest *ManifestWriter